@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+const bufferUsage = `Usage: sir buffer <command> [options]
+
+Inspects and edits the buffer of a backend while the relay is stopped.
+
+Commands:
+  ls       summary of the buffered batches per database and retention policy
+  export   writes the buffered points as line protocol
+  import   buffers the points of line protocol files
+  purge    removes buffered batches
+  replay   writes the buffered batches to another backend, removing them once acknowledged
+
+The buffer is either given by its path, or by the configuration
+file and the alias of its backend. Run sir buffer <command> -h
+for the options of each command.
+`
+
+// importBatchSize is the number of points per imported batch
+const importBatchSize = 5000
+
+// bufferOptions are the options shared by the buffer commands
+type bufferOptions struct {
+	config *string
+	server *string
+	path   *string
+	shared *string
+	key    *string
+	filter endpoint.BufferFilter
+	// set from the configuration file
+	endpoints map[string]*endpoint.HTTPInfluxServer
+	replayer  *endpoint.Replayer
+}
+
+func newBufferFlags(name string, filters bool) (*flag.FlagSet, *bufferOptions) {
+	fs := flag.NewFlagSet("sir buffer "+name, flag.ExitOnError)
+	o := &bufferOptions{
+		config: fs.String("file", "sir.conf", "Configuration file for SIR"),
+		server: fs.String("server", "", "Alias of the backend owning the buffer"),
+		path:   fs.String("path", "", "Path of the buffer, instead of -file and -server"),
+		shared: fs.String("shared", "", "Path of the shared buffer used along with -path, if any"),
+		key:    fs.String("key", "", "Encryption key of the buffer, as file:<path> or env:<variable>"),
+	}
+	if filters {
+		fs.StringVar(&o.filter.Database, "database", "", "Only the batches of this database")
+		fs.StringVar(&o.filter.RetentionPolicy, "retention-policy", "", "Only the batches of this retention policy")
+	}
+	return fs, o
+}
+
+// open initialises the buffer, creating it if asked to.
+// It fails if the relay or another command is using it.
+func (o *bufferOptions) open(create bool) (*endpoint.Bufferer, error) {
+	b, err := o.bufferer()
+	if err != nil {
+		return nil, err
+	}
+	if b.Shared != nil {
+		// the blobs of the other buffers are not referenced here
+		b.Shared.NoSweep = true
+	}
+	if _, err := os.Stat(b.RootPath); os.IsNotExist(err) && !create {
+		return nil, fmt.Errorf("No buffer in %v", b.RootPath)
+	}
+	return b, b.Init()
+}
+
+// openReadOnly loads the buffer without writing to it,
+// neither recovering the files of older versions
+func (o *bufferOptions) openReadOnly() (*endpoint.Bufferer, error) {
+	b, err := o.bufferer()
+	if err != nil {
+		return nil, err
+	}
+	b.ReadOnly = true
+	if b.Shared != nil {
+		b.Shared.ReadOnly = true
+	}
+	if _, err := os.Stat(b.RootPath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("No buffer in %v", b.RootPath)
+	}
+	return b, b.Init()
+}
+
+// bufferer returns the buffer given by the options
+func (o *bufferOptions) bufferer() (*endpoint.Bufferer, error) {
+	var b *endpoint.Bufferer
+	if *o.path != "" {
+		b = endpoint.NewBufferer()
+		b.RootPath = *o.path
+		b.KeySource = *o.key
+		if *o.shared != "" {
+			if err := endpoint.NewSharedBuffer(*o.shared).Attach(b); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		if *o.server == "" {
+			return nil, errors.New("Either -path or -server is required")
+		}
+		conf, err := ioutil.ReadFile(*o.config)
+		if err != nil {
+			return nil, err
+		}
+		mgr, err := endpoint.NewHTTPInfluxServerMgrFromConfig(string(conf))
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing configuration: %v", err)
+		}
+		s, ok := mgr.Endpoints[*o.server]
+		if !ok {
+			return nil, fmt.Errorf("Unknown server %v", *o.server)
+		}
+		if !s.Buffering || s.Bufferer.Type != endpoint.BufferTypeDisk {
+			return nil, fmt.Errorf("Server %v has no disk buffer", *o.server)
+		}
+		b = s.Bufferer
+		o.endpoints = mgr.Endpoints
+		o.replayer = s.Replayer
+		if *o.key != "" {
+			b.KeySource = *o.key
+		}
+	}
+	return b, nil
+}
+
+// bufferCommand runs the buffer subcommands,
+// returning the exit code of the process
+func bufferCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, bufferUsage)
+		return 2
+	}
+	var err error
+	switch args[0] {
+	case "ls":
+		err = bufferList(args[1:])
+	case "export":
+		err = bufferExport(args[1:])
+	case "import":
+		err = bufferImport(args[1:])
+	case "purge":
+		err = bufferPurge(args[1:])
+	case "replay":
+		err = bufferReplay(args[1:])
+	default:
+		fmt.Fprint(os.Stderr, bufferUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sir buffer %v: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func bufferList(args []string) error {
+	fs, o := newBufferFlags("ls", false)
+	fs.Parse(args)
+	b, err := o.openReadOnly()
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	type summary struct {
+		records, points int
+		bytes           int64
+		oldest, newest  time.Time
+	}
+	var keys [][2]string
+	summaries := make(map[[2]string]*summary)
+	total := &summary{}
+	for _, bf := range b.Index {
+		k := [2]string{bf.Database, bf.RetentionPolicy}
+		s, ok := summaries[k]
+		if !ok {
+			s = &summary{}
+			summaries[k] = s
+			keys = append(keys, k)
+		}
+		for _, s := range []*summary{s, total} {
+			if s.records == 0 {
+				s.oldest = bf.Timestamp
+			}
+			s.records++
+			s.points += bf.NumMetrics
+			// the body of a shared record is a blob
+			s.bytes += bf.Size + bf.Shared
+			s.newest = bf.Timestamp
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DATABASE\tRETENTION POLICY\tBATCHES\tPOINTS\tBYTES\tOLDEST\tNEWEST")
+	line := func(db, rp string, s *summary) {
+		if s.records == 0 {
+			fmt.Fprintf(w, "%v\t%v\t0\t0\t0\t-\t-\n", db, rp)
+			return
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", db, rp, s.records, s.points, s.bytes,
+			s.oldest.Format(time.RFC3339), s.newest.Format(time.RFC3339))
+	}
+	for _, k := range keys {
+		line(k[0], k[1], summaries[k])
+	}
+	line("total", "", total)
+	return w.Flush()
+}
+
+func bufferExport(args []string) error {
+	fs, o := newBufferFlags("export", true)
+	out := fs.String("out", "-", "Output file, - for stdout")
+	fs.Parse(args)
+	b, err := o.openReadOnly()
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	// same format as influx_inspect export
+	fmt.Fprintln(bw, "# DML")
+	var db, rp string
+	first := true
+	err = b.Each(func(bf *endpoint.BufferFile, bp client.BatchPoints) error {
+		if !o.filter.Match(bf) {
+			return nil
+		}
+		if first || bp.Database() != db || bp.RetentionPolicy() != rp {
+			db, rp, first = bp.Database(), bp.RetentionPolicy(), false
+			fmt.Fprintf(bw, "# CONTEXT-DATABASE: %v\n# CONTEXT-RETENTION-POLICY: %v\n", db, rp)
+		}
+		for _, p := range bp.Points() {
+			bw.WriteString(p.String())
+			bw.WriteByte('\n')
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func bufferImport(args []string) error {
+	fs, o := newBufferFlags("import", false)
+	db := fs.String("database", "", "Database of the points, unless set by a CONTEXT-DATABASE comment")
+	rp := fs.String("retention-policy", "", "Retention policy of the points, unless set by a CONTEXT-RETENTION-POLICY comment")
+	precision := fs.String("precision", "ns", "Precision of the timestamps")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("No file to import")
+	}
+	b, err := o.open(true)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	var imported int
+	for _, name := range fs.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		n, err := importLines(b, f, *db, *rp, *precision)
+		f.Close()
+		imported += n
+		if err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+	}
+	fmt.Printf("Imported %v points\n", imported)
+	return nil
+}
+
+// importLines buffers the line protocol read from r,
+// returning the number of points imported
+func importLines(b *endpoint.Bufferer, r io.Reader, db, rp, precision string) (int, error) {
+	var imported int
+	var bp client.BatchPoints
+	flush := func() error {
+		if bp == nil || len(bp.Points()) == 0 {
+			return nil
+		}
+		imported += len(bp.Points())
+		err := b.Write(bp)
+		bp = nil
+		return err
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "# CONTEXT-DATABASE:"):
+			if err := flush(); err != nil {
+				return imported, err
+			}
+			db = strings.TrimSpace(strings.TrimPrefix(line, "# CONTEXT-DATABASE:"))
+			continue
+		case strings.HasPrefix(line, "# CONTEXT-RETENTION-POLICY:"):
+			if err := flush(); err != nil {
+				return imported, err
+			}
+			rp = strings.TrimSpace(strings.TrimPrefix(line, "# CONTEXT-RETENTION-POLICY:"))
+			continue
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		}
+		if db == "" {
+			return imported, fmt.Errorf("line %v: no database, use -database", lineno)
+		}
+		pts, err := models.ParsePointsWithPrecision([]byte(line), time.Now().UTC(), precision)
+		if err != nil {
+			return imported, fmt.Errorf("line %v: %v", lineno, err)
+		}
+		if bp == nil {
+			if bp, err = client.NewBatchPoints(client.BatchPointsConfig{Database: db, RetentionPolicy: rp}); err != nil {
+				return imported, err
+			}
+		}
+		for _, p := range pts {
+			bp.AddPoint(client.NewPointFrom(p))
+		}
+		if len(bp.Points()) >= importBatchSize {
+			if err := flush(); err != nil {
+				return imported, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return imported, err
+	}
+	return imported, flush()
+}
+
+func bufferPurge(args []string) error {
+	fs, o := newBufferFlags("purge", true)
+	before := fs.String("before", "", "Only the batches buffered before this time, RFC3339")
+	age := fs.Duration("older-than", 0, "Only the batches buffered for longer than this duration")
+	all := fs.Bool("all", false, "Purge the whole buffer")
+	fs.Parse(args)
+
+	if *before != "" {
+		t, err := time.Parse(time.RFC3339, *before)
+		if err != nil {
+			return err
+		}
+		o.filter.Before = t
+	}
+	if *age > 0 {
+		t := time.Now().Add(-*age)
+		if o.filter.Before.IsZero() || t.Before(o.filter.Before) {
+			o.filter.Before = t
+		}
+	}
+	if o.filter == (endpoint.BufferFilter{}) && !*all {
+		return errors.New("No filter given, use -all to purge the whole buffer")
+	}
+
+	b, err := o.open(false)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	n, err := b.Purge(&o.filter)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Purged %v points\n", n)
+	return nil
+}
+
+func bufferReplay(args []string) error {
+	fs, o := newBufferFlags("replay", false)
+	target := fs.String("target", "", "Alias of a backend of the configuration, or URL of an Influx")
+	rate := fs.Int64("rate", -1, "Max points per second, 0 for no limit (default: from the configuration)")
+	concurrency := fs.Int("concurrency", 0, "Concurrent requests (default: from the configuration)")
+	fs.Parse(args)
+	if *target == "" {
+		return errors.New("-target is required")
+	}
+
+	b, err := o.open(false)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	r := endpoint.NewReplayer()
+	if o.replayer != nil {
+		r = o.replayer
+	}
+	if *rate >= 0 {
+		r.MaxRate = float64(*rate)
+	}
+	if *concurrency > 0 {
+		r.Concurrency = *concurrency
+	}
+
+	dst, ok := o.endpoints[*target]
+	if !ok {
+		if dst, err = endpoint.NewHTTPInfluxServerFromURL(*target); err != nil {
+			return err
+		}
+		defer dst.Close()
+	} else if err = dst.Connect(); err != nil {
+		return err
+	}
+
+	// stops cleanly on ^C, keeping what is not acknowledged
+	stop := make(chan struct{})
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		<-c
+		close(stop)
+	}()
+	err = endpoint.DrainBuffer(b, r, dst, stop)
+	fmt.Printf("Replayed %v points, %v left\n", r.Replayed, len(b.Index))
+	return err
+}
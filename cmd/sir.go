@@ -38,6 +38,10 @@ frequency = "5s"
 
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "buffer" {
+		os.Exit(bufferCommand(os.Args[2:]))
+	}
+
 	var config = flag.String("file", "sir.conf", "Configuration file for SIR")
 	//var debug = flag.Bool("debug", false, "Debug Mode")
 
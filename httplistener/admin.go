@@ -0,0 +1,84 @@
+package httplistener
+
+import (
+	"net/http"
+)
+
+// replayPath is the admin endpoint moving
+// the buffer of a backend to another one
+const replayPath = "/buffer/replay"
+
+// isAdmin returns true if the user is allowed to
+// use the admin endpoints. They are disabled
+// unless users and admin users are configured.
+func (h *HTTP) isAdmin(user string) bool {
+	if user == "" {
+		return false
+	}
+	for _, u := range h.AdminUsers {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// serveReplay manages the buffer replays:
+// GET lists them, POST starts the replay of the
+// source backlog to the target (an alias or an
+// Influx URL) and DELETE stops it.
+func (h *HTTP) serveReplay(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.authenticate(r)
+	if !ok {
+		jsonError(w, http.StatusUnauthorized, "authorization failed")
+		return
+	}
+	if !h.isAdmin(user) {
+		jsonError(w, http.StatusForbidden, "admin access required")
+		return
+	}
+	if h.BackendMgr == nil {
+		jsonError(w, http.StatusServiceUnavailable, "no backend")
+		return
+	}
+
+	source := r.URL.Query().Get("source")
+	var err error
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(h.BackendMgr.Replays())
+		return
+	case "POST":
+		target := r.URL.Query().Get("target")
+		if source == "" || target == "" {
+			jsonError(w, http.StatusBadRequest, "missing parameter: source and target required")
+			return
+		}
+		if err = h.BackendMgr.ReplayBuffer(source, target); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			w.Write(h.BackendMgr.Replays())
+			return
+		}
+	case "DELETE":
+		if source == "" {
+			jsonError(w, http.StatusBadRequest, "missing parameter: source")
+			return
+		}
+		if err = h.BackendMgr.StopReplay(source); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	default:
+		jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	code := http.StatusInternalServerError
+	if sc, ok := err.(statusCoder); ok {
+		code = sc.StatusCode()
+	}
+	jsonError(w, code, err.Error())
+}
@@ -0,0 +1,205 @@
+package httplistener
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+const (
+	// defaultClass is the priority class of the
+	// databases matching no pattern
+	defaultClass string = "default"
+	// defaultRetryAfter is the delay suggested
+	// to throttled clients, in seconds
+	defaultRetryAfter = 1
+)
+
+// AdmissionConfig is the struct to map
+// the admission control from config items
+type AdmissionConfig struct {
+	MaxRequests int64 `toml:"max_requests"`
+	MaxBytes    int64 `toml:"max_bytes"`
+	// MaxPressure is the saturation of the backends,
+	// between 0 and 1, past which writes are throttled
+	MaxPressure float64 `toml:"max_pressure"`
+	RetryAfter  int     `toml:"retry_after"`
+	// Classes gives the share of the budget usable by each
+	// priority class, Databases the patterns of each class
+	Classes   map[string]float64  `toml:"classes"`
+	Databases map[string][]string `toml:"databases"`
+}
+
+// AdmissionClass is a priority class, throttled
+// once Share of the budget is in use
+type AdmissionClass struct {
+	Admitted  uint64
+	Throttled uint64
+	Name      string
+	Share     float64
+}
+
+type classPattern struct {
+	pattern *regexp.Regexp
+	class   *AdmissionClass
+}
+
+// Admission bounds the writes in flight, from the
+// listener to the backends queues, so that clients get
+// a 429 rather than piling up requests when saturated.
+type Admission struct {
+	requests    int64
+	bytes       int64
+	MaxRequests int64
+	MaxBytes    int64
+	MaxPressure float64
+	RetryAfter  int
+	Classes     map[string]*AdmissionClass
+	patterns    []classPattern
+}
+
+// NewAdmissionFromConfig creates the admission control.
+// Returns nil when no limit is set.
+func NewAdmissionFromConfig(c *AdmissionConfig) *Admission {
+	if c.MaxRequests <= 0 && c.MaxBytes <= 0 && c.MaxPressure <= 0 {
+		return nil
+	}
+	a := &Admission{
+		MaxRequests: c.MaxRequests,
+		MaxBytes:    c.MaxBytes,
+		MaxPressure: c.MaxPressure,
+		RetryAfter:  c.RetryAfter,
+		Classes:     make(map[string]*AdmissionClass),
+	}
+	if a.RetryAfter <= 0 {
+		a.RetryAfter = defaultRetryAfter
+	}
+	a.class(defaultClass)
+	for name, share := range c.Classes {
+		if share <= 0 || share > 1 {
+			log.Printf("Ignoring share %v of priority class %v: must be in ]0, 1]", share, name)
+			continue
+		}
+		a.class(name).Share = share
+	}
+	for name, patterns := range c.Databases {
+		for _, p := range patterns {
+			reg, err := endpoint.CompilePattern(p)
+			if err != nil {
+				log.Printf("Ignoring pattern %q of priority class %v: %v", p, name, err)
+				continue
+			}
+			a.patterns = append(a.patterns, classPattern{reg, a.class(name)})
+		}
+	}
+	// a database matching several classes gets the highest
+	sort.Slice(a.patterns, func(i, j int) bool {
+		ci, cj := a.patterns[i].class, a.patterns[j].class
+		if ci.Share != cj.Share {
+			return ci.Share > cj.Share
+		}
+		return ci.Name < cj.Name
+	})
+	return a
+}
+
+// class returns the named class, created with the full budget
+func (a *Admission) class(name string) *AdmissionClass {
+	c, ok := a.Classes[name]
+	if !ok {
+		c = &AdmissionClass{Name: name, Share: 1}
+		a.Classes[name] = c
+	}
+	return c
+}
+
+// classOf returns the priority class of the database
+func (a *Admission) classOf(db string) *AdmissionClass {
+	for _, p := range a.patterns {
+		if p.pattern.MatchString(db) {
+			return p.class
+		}
+	}
+	return a.Classes[defaultClass]
+}
+
+// admissionTicket holds the budget used by a request
+type admissionTicket struct {
+	a     *Admission
+	bytes int64
+}
+
+// admit reserves the budget of a write of size bytes to db.
+// Returns false if its class is over its share of the budget,
+// given the pressure of the backends.
+func (a *Admission) admit(db string, size int64, pressure float64) (*admissionTicket, bool) {
+	c := a.classOf(db)
+	requests := atomic.AddInt64(&a.requests, 1)
+	bytes := atomic.AddInt64(&a.bytes, size)
+	over := a.MaxRequests > 0 && float64(requests) > c.Share*float64(a.MaxRequests)
+	// a single write always gets through, the body size is not bounded here
+	over = over || (a.MaxBytes > 0 && requests > 1 && float64(bytes) > c.Share*float64(a.MaxBytes))
+	over = over || (a.MaxPressure > 0 && pressure >= c.Share*a.MaxPressure)
+	if over {
+		atomic.AddInt64(&a.requests, -1)
+		atomic.AddInt64(&a.bytes, -size)
+		atomic.AddUint64(&c.Throttled, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&c.Admitted, 1)
+	return &admissionTicket{a: a, bytes: size}, true
+}
+
+// grow accounts for bytes read beyond the announced size
+func (t *admissionTicket) grow(n int64) {
+	if n > t.bytes {
+		atomic.AddInt64(&t.a.bytes, n-t.bytes)
+		t.bytes = n
+	}
+}
+
+// release returns the budget of the request
+func (t *admissionTicket) release() {
+	atomic.AddInt64(&t.a.requests, -1)
+	atomic.AddInt64(&t.a.bytes, -t.bytes)
+}
+
+// throttle answers a request refused by the admission control
+func (a *Admission) throttle(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(a.RetryAfter))
+	jsonError(w, http.StatusTooManyRequests, "too many requests in flight")
+}
+
+// Stats collects statistics from the admission control
+func (a *Admission) Stats() ([]models.Point, error) {
+	now := time.Now()
+	fields := map[string]interface{}{
+		"requests": atomic.LoadInt64(&a.requests),
+		"bytes":    atomic.LoadInt64(&a.bytes),
+	}
+	pt, err := models.NewPoint("sir_admission", models.NewTags(map[string]string{}), fields, now)
+	if err != nil {
+		return nil, err
+	}
+	pts := []models.Point{pt}
+	for name, c := range a.Classes {
+		fields = map[string]interface{}{
+			"admitted":  int64(atomic.LoadUint64(&c.Admitted)),
+			"throttled": int64(atomic.LoadUint64(&c.Throttled)),
+			"share":     c.Share,
+		}
+		pt, err = models.NewPoint("sir_admission", models.NewTags(map[string]string{"class": name}), fields, now)
+		if err != nil {
+			return nil, err
+		}
+		pts = append(pts, pt)
+	}
+	return pts, nil
+}
@@ -0,0 +1,49 @@
+package httplistener_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/sledigabel/sir/httplistener"
+)
+
+func TestAdmission(t *testing.T) {
+
+	h := httplistener.NewHTTP()
+	h.Addr = "localhost:19995"
+	h.Admission = httplistener.NewAdmissionFromConfig(&httplistener.AdmissionConfig{
+		MaxPressure: 1,
+		RetryAfter:  2,
+		Classes:     map[string]float64{"default": 0.5, "critical": 1},
+		Databases:   map[string][]string{"critical": {"alerts"}},
+	})
+	m, stop := startListener(t, h)
+	defer stop()
+
+	if resp, _ := write(t, h, "db=test", "cpu value=1"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Write should be admitted: %v", resp.StatusCode)
+	}
+	// the default class is throttled first
+	m.Load = 0.6
+	if resp, _ := write(t, h, "db=test", "cpu value=1"); resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "2" {
+		t.Errorf("Write should be throttled: %v %v", resp.StatusCode, resp.Header)
+	}
+	if resp, _ := write(t, h, "db=alerts", "cpu value=1"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Critical write should be admitted: %v", resp.StatusCode)
+	}
+	// the patterns match whole database names
+	if resp, _ := write(t, h, "db=alerts_test", "cpu value=1"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Write out of the critical class should be throttled: %v", resp.StatusCode)
+	}
+
+	pts, err := h.Stats()
+	if err != nil || len(pts) != 3 {
+		t.Fatalf("Could not get stats: %v %v", pts, err)
+	}
+	for _, pt := range pts {
+		fields, _ := pt.Fields()
+		if pt.Tags().GetString("class") == "default" && (fields["admitted"] != int64(1) || fields["throttled"] != int64(2)) {
+			t.Errorf("Wrong stats: %v", fields)
+		}
+	}
+}
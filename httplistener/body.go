@@ -0,0 +1,203 @@
+package httplistener
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+const (
+	// DefaultBatchSize is the number of lines
+	// relayed per sub-batch of a write
+	DefaultBatchSize = 5000
+	// maxReportedLines bounds the number of
+	// dropped lines listed in a partial write error
+	maxReportedLines = 20
+)
+
+var (
+	// errBodyTooLarge is returned past the body size limits,
+	// with the message of Influx
+	errBodyTooLarge = errors.New("http: request body too large")
+	// errLineTooLong is returned past the line length limit
+	errLineTooLong = errors.New("line too long")
+)
+
+// limitedReader fails with errBodyTooLarge
+// past max bytes, 0 meaning no limit
+type limitedReader struct {
+	r   io.Reader
+	max int64
+	n   int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.max > 0 && l.n > l.max {
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
+
+// readLine appends the next line of r to line, newline
+// included. It fails past max bytes, 0 meaning no limit.
+func readLine(r *bufio.Reader, max int, line []byte) ([]byte, error) {
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if max > 0 && len(line) > max && !(len(line) == max+1 && line[max] == '\n') {
+			return line, errLineTooLong
+		}
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// writeRequest is the state of a write
+// being parsed in sub-batches
+type writeRequest struct {
+	user      string
+	db        string
+	precision string
+	start     time.Time
+	opts      *endpoint.WriteOptions
+	// points parsed and accepted so far, and the
+	// size of the lines they were parsed from
+	points   int
+	accepted int
+	bytes    int
+	// batch holds the accepted points until
+	// the whole write is read and checked
+	batch []models.Point
+	// lines dropped, and the first reasons
+	dropped  int
+	failures []string
+	// points clamped to the time bounds
+	clamped int
+}
+
+// drop records a line dropped for the given reason
+func (wr *writeRequest) drop(reason string) {
+	wr.dropped++
+	if len(wr.failures) < maxReportedLines {
+		wr.failures = append(wr.failures, reason)
+	}
+}
+
+// parseFailed records the lines rejected by the parser,
+// one per line of the error
+func (wr *writeRequest) parseFailed(err error) {
+	for _, f := range strings.Split(err.Error(), "\n") {
+		wr.drop(f)
+	}
+}
+
+// parseError returns the error answered for the
+// dropped lines, as Influx: a partial write
+// if some points were accepted
+func (wr *writeRequest) parseError() string {
+	reason := strings.Join(wr.failures, "\n")
+	if more := wr.dropped - len(wr.failures); more > 0 {
+		reason = fmt.Sprintf("%v\n(%v more)", reason, more)
+	}
+	if wr.accepted == 0 {
+		return reason
+	}
+	reason = fmt.Sprintf("partial write: %v dropped=%v", reason, wr.dropped)
+	if wr.clamped > 0 {
+		reason = fmt.Sprintf("%v clamped=%v", reason, wr.clamped)
+	}
+	return reason
+}
+
+// readError answers a failed read of the body
+func readError(w http.ResponseWriter, err error) {
+	switch err {
+	case errBodyTooLarge:
+		jsonError(w, http.StatusRequestEntityTooLarge, err.Error())
+	case errLineTooLong:
+		jsonError(w, http.StatusBadRequest, fmt.Sprintf("unable to parse: %v", err))
+	default:
+		jsonError(w, http.StatusInternalServerError, "Failed reading request body")
+	}
+}
+
+// parse parses a sub-batch of lines, keeping the valid points
+// until the whole write is read: nothing is relayed before the
+// limits are checked. It returns false if the write is refused,
+// having answered the request.
+func (h *HTTP) parse(w http.ResponseWriter, wr *writeRequest, data []byte) bool {
+	points, err := models.ParsePointsWithPrecision(data, wr.start, wr.precision)
+	if err != nil {
+		wr.parseFailed(err)
+	}
+	if h.MaxPoints > 0 && wr.points+len(points) > h.MaxPoints {
+		jsonError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("too many points, the limit is %v", h.MaxPoints))
+		return false
+	}
+	wr.points += len(points)
+	wr.bytes += len(data)
+	if tb := h.timestampBounds(wr.db); tb != nil {
+		if points, err = tb.filter(points, wr.start, wr); err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return false
+		}
+	}
+	wr.accepted += len(points)
+	wr.batch = append(wr.batch, points...)
+	return true
+}
+
+// relay posts the points of a write read and checked as a whole
+// to the backends, in sub-batches of batchSize points. It returns
+// false if the write failed, having answered the request.
+func (h *HTTP) relay(w http.ResponseWriter, r *http.Request, wr *writeRequest, batchSize int) bool {
+	points := wr.batch
+	var ok bool
+	if len(h.RateLimits) > 0 {
+		if points, ok = h.limit(w, r, wr.user, wr.db, points, wr.bytes); !ok {
+			return false
+		}
+	}
+	if h.BackendMgr == nil {
+		return true
+	}
+
+	for len(points) > 0 {
+		n := batchSize
+		if n > len(points) {
+			n = len(points)
+		}
+		bp, err := client.NewBatchPoints(client.BatchPointsConfig{
+			Database:  wr.db,
+			Precision: wr.precision,
+		})
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return false
+		}
+		for _, p := range points[:n] {
+			bp.AddPoint(client.NewPointFrom(p))
+		}
+		if err = h.BackendMgr.PostWithOptions(bp, wr.opts); err != nil {
+			code := http.StatusServiceUnavailable
+			if sc, ok := err.(statusCoder); ok {
+				code = sc.StatusCode()
+			}
+			jsonError(w, code, err.Error())
+			return false
+		}
+		points = points[n:]
+	}
+	return true
+}
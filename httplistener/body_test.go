@@ -0,0 +1,94 @@
+package httplistener_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/sledigabel/sir/httplistener"
+)
+
+func TestBodyLimits(t *testing.T) {
+
+	h := httplistener.NewHTTP()
+	h.Addr = "localhost:19993"
+	h.MaxBodySize = 1000
+	h.MaxDecompressedSize = 2000
+	h.MaxLineLength = 20
+	h.MaxPoints = 4
+	h.BatchSize = 2
+	m, stop := startListener(t, h)
+	defer stop()
+
+	post := func(body []byte, gzipped bool) int {
+		rq, _ := http.NewRequest("POST", "http://localhost:19993/write?db=test", bytes.NewReader(body))
+		if gzipped {
+			rq.Header.Set("Content-Encoding", "gzip")
+		}
+		resp, err := http.DefaultClient.Do(rq)
+		if err != nil {
+			t.Fatalf("Can't connect to server: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	gz := func(body []byte) []byte {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(body)
+		w.Close()
+		return buf.Bytes()
+	}
+
+	if code := post([]byte("cpu value=1\ncpu value=2\ncpu value=3\ncpu value=4"), false); code != http.StatusNoContent {
+		t.Errorf("Write within the limits should succeed: %v", code)
+	}
+	if len(m.Points) != 4 {
+		t.Errorf("Expected 4 points relayed, got %v", len(m.Points))
+	}
+	if code := post([]byte("cpu value=1\ncpu value=2\ncpu value=3\ncpu value=4\ncpu value=5"), false); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Write over the points limit should fail with 413: %v", code)
+	}
+	if code := post([]byte("cpu value=1\ncpu value=2\ncpu,host=a-very-long-host-name value=1"), false); code != http.StatusBadRequest {
+		t.Errorf("Write over the line limit should fail with 400: %v", code)
+	}
+	// the sub-batches read before the failures are not relayed
+	if len(m.Points) != 4 {
+		t.Errorf("Expected no point relayed by the failed writes, got %v", len(m.Points)-4)
+	}
+	if code := post(bytes.Repeat([]byte("cpu value=1\n"), 100), false); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Write over the body limit should fail with 413: %v", code)
+	}
+	// compresses well under the body limit
+	if code := post(gz(bytes.Repeat([]byte("# comment\n"), 1000)), true); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Write over the decompressed limit should fail with 413: %v", code)
+	}
+	if code := post([]byte("cpu value=1"), true); code != http.StatusBadRequest {
+		t.Errorf("Write with a bad gzip body should fail with 400: %v", code)
+	}
+}
+
+func TestPartialWrite(t *testing.T) {
+
+	h := httplistener.NewHTTP()
+	h.Addr = "localhost:19988"
+	m, stop := startListener(t, h)
+	defer stop()
+
+	resp, body := write(t, h, "db=test", "cpu value=1\ncpu value=\ncpu value=2")
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "partial write: unable to parse 'cpu value='") || !strings.Contains(body, "dropped=1") {
+		t.Errorf("Expected a partial write, got %v %v", resp.StatusCode, body)
+	}
+	if len(m.Points) != 2 {
+		t.Errorf("Expected the valid points to be relayed, got %v", len(m.Points))
+	}
+	resp, body = write(t, h, "db=test", "cpu value=\nmem")
+	if resp.StatusCode != http.StatusBadRequest || strings.Contains(body, "partial write") || !strings.Contains(body, "unable to parse 'mem'") {
+		t.Errorf("Expected a parse error, got %v %v", resp.StatusCode, body)
+	}
+	if len(m.Points) != 2 {
+		t.Errorf("Expected no point relayed, got %v", len(m.Points))
+	}
+}
@@ -1,28 +1,55 @@
 package httplistener
 
 import (
+	"bufio"
 	"compress/gzip"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/influxdata/influxdb/client/v2"
 	"github.com/influxdata/influxdb/models"
+	"github.com/sledigabel/sir/influx-endpoint"
 )
 
 const (
-	defaultAddr string = ":8186"
-	defaultRP   string = "autogen"
+	defaultAddr    string = ":8186"
+	defaultRP      string = "autogen"
+	backendsHeader string = "X-Sir-Backends"
+	backendsParam  string = "sir_backends"
+)
+
+// defaults of the write limits of the configuration,
+// a write is held in memory until it is checked as a whole
+const (
+	DefaultMaxBodySize         int64 = 25 * 1024 * 1024
+	DefaultMaxDecompressedSize int64 = 250 * 1024 * 1024
+	DefaultMaxPoints                 = 1000000
 )
 
 // Backend represents a backend
 // entity to relay metrics to
 type Backend interface {
 	Post(client.BatchPoints) error
+	PostWithOptions(client.BatchPoints, *endpoint.WriteOptions) error
 	Status() []byte
+	ReplayBuffer(source, target string) error
+	StopReplay(source string) error
+	Replays() []byte
+	// Pressure returns the saturation of the backends,
+	// from 0 (idle) to 1 (writers block)
+	Pressure() float64
+}
+
+// statusCoder is implemented by the backend
+// errors mapping to a specific HTTP status
+type statusCoder interface {
+	StatusCode() int
 }
 
 // HTTP is a relay for HTTP influxdb writes
@@ -38,6 +65,23 @@ type HTTP struct {
 	Debug            bool
 	DebugConnections bool
 	BackendMgr       Backend
+	Users            map[string]string
+	OverrideUsers    []string
+	AdminUsers       []string
+	// limits of the writes, 0 meaning no limit
+	MaxBodySize         int64
+	MaxDecompressedSize int64
+	MaxLineLength       int
+	MaxPoints           int
+	// BatchSize is the number of lines relayed per sub-batch
+	BatchSize int
+	// Admission throttles the writes when set
+	Admission *Admission
+	// RateLimits apply in order to each write
+	RateLimits []*RateLimiter
+	// Timestamps bound the time of the points, the
+	// first bounds matching the database apply
+	Timestamps []*TimestampBounds
 }
 
 // HTTPConf is the basic config structure for HTTP
@@ -47,7 +91,18 @@ type HTTPConf struct {
 	RetentionPolicy  string `toml:"retention_policy"`
 	Timeout          int
 	Debug            bool
-	DebugConnections bool `toml:"log"`
+	DebugConnections bool                    `toml:"log"`
+	Users            map[string]string       `toml:"users"`
+	OverrideUsers    []string                `toml:"override_users"`
+	AdminUsers       []string                `toml:"admin_users"`
+	Admission        AdmissionConfig         `toml:"admission"`
+	RateLimits       []RateLimitConfig       `toml:"rate_limit"`
+	MaxBodySize      int64                   `toml:"max_body_size"`
+	MaxDecompressed  int64                   `toml:"max_decompressed_size"`
+	MaxLineLength    int                     `toml:"max_line_length"`
+	MaxPoints        int                     `toml:"max_points"`
+	BatchSize        int                     `toml:"batch_size"`
+	Timestamps       []TimestampBoundsConfig `toml:"timestamps"`
 }
 
 type responseData struct {
@@ -89,9 +144,32 @@ func NewHTTPfromConfig(hc *HTTPConf) *HTTP {
 	h := NewHTTPWithParameters(hc.Addr, hc.Certificate, hc.RetentionPolicy, hc.Timeout)
 	h.Debug = hc.Debug
 	h.DebugConnections = hc.DebugConnections
+	h.Users = hc.Users
+	h.OverrideUsers = hc.OverrideUsers
+	h.AdminUsers = hc.AdminUsers
+	h.Admission = NewAdmissionFromConfig(&hc.Admission)
+	h.RateLimits = newRateLimiters(hc.RateLimits)
+	h.MaxBodySize = writeLimit(hc.MaxBodySize, DefaultMaxBodySize)
+	h.MaxDecompressedSize = writeLimit(hc.MaxDecompressed, DefaultMaxDecompressedSize)
+	h.MaxLineLength = hc.MaxLineLength
+	h.MaxPoints = int(writeLimit(int64(hc.MaxPoints), DefaultMaxPoints))
+	h.BatchSize = hc.BatchSize
+	h.Timestamps = newTimestampBounds(hc.Timestamps)
 	return h
 }
 
+// writeLimit returns the limit of the configuration,
+// the default when unset and no limit when negative
+func writeLimit(v, def int64) int64 {
+	switch {
+	case v == 0:
+		return def
+	case v < 0:
+		return 0
+	}
+	return v
+}
+
 type listener HTTPConf
 type myconf struct {
 	Listener listener
@@ -104,6 +182,33 @@ func NewHTTPParseConfig(conf string) (*HTTPConf, error) {
 	return &hc, err
 }
 
+// Stats collects statistics from the listener
+func (h *HTTP) Stats() ([]models.Point, error) {
+	var pts []models.Point
+	if h.Admission != nil {
+		apts, err := h.Admission.Stats()
+		if err != nil {
+			return nil, err
+		}
+		pts = append(pts, apts...)
+	}
+	for _, l := range h.RateLimits {
+		pt, err := l.Stats()
+		if err != nil {
+			return nil, err
+		}
+		pts = append(pts, pt)
+	}
+	for _, tb := range h.Timestamps {
+		pt, err := tb.Stats()
+		if err != nil {
+			return nil, err
+		}
+		pts = append(pts, pt)
+	}
+	return pts, nil
+}
+
 func (h *HTTP) toString() string {
 	if h.Certificate != "" {
 		return fmt.Sprintf("https://%v", h.Addr)
@@ -111,15 +216,61 @@ func (h *HTTP) toString() string {
 	return fmt.Sprintf("http://%v", h.Addr)
 }
 
+// authenticate checks the request credentials against
+// the configured users. Without users, everyone is anonymous.
+func (h *HTTP) authenticate(r *http.Request) (string, bool) {
+	if len(h.Users) == 0 {
+		return "", true
+	}
+	user, password, ok := credentials(r)
+	if !ok {
+		return "", false
+	}
+	if expected, ok := h.Users[user]; !ok || expected != password {
+		return "", false
+	}
+	return user, true
+}
+
+// canOverride returns true if the user is
+// allowed to override the routing
+func (h *HTTP) canOverride(user string) bool {
+	if user == "" {
+		return false
+	}
+	for _, u := range h.OverrideUsers {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// backendsOverride returns the list of backends
+// requested by header or query parameter
+func backendsOverride(r *http.Request) []string {
+	list := r.Header.Get(backendsHeader)
+	if list == "" {
+		list = r.URL.Query().Get(backendsParam)
+	}
+	var backends []string
+	for _, b := range strings.Split(list, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			backends = append(backends, b)
+		}
+	}
+	return backends
+}
+
 func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
+	w.Header().Set("X-InfluxDB-Version", "relay")
 
 	if h.DebugConnections {
 		log.Printf("Connection: %v [%v %v] (%v)", r.RemoteAddr, r.Method, r.URL.RequestURI(), r.ContentLength)
 	}
 
 	if r.URL.Path == "/ping" && (r.Method == "GET" || r.Method == "HEAD") {
-		w.Header().Add("X-InfluxDB-Version", "relay")
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
@@ -130,7 +281,6 @@ func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.URL.Path == "/status" && r.Method == "GET" {
-		w.Header().Add("X-InfluxDB-Version", "relay")
 		w.WriteHeader(http.StatusOK)
 		if h.BackendMgr != nil {
 			w.Write(h.BackendMgr.Status())
@@ -140,12 +290,34 @@ func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Path == replayPath {
+		h.serveReplay(w, r)
+		return
+	}
+
 	// we only accept writes
 	if r.URL.Path != "/write" {
 		jsonError(w, http.StatusNotFound, "invalid endpoint")
 		return
 	}
 
+	user, ok := h.authenticate(r)
+	if !ok {
+		jsonError(w, http.StatusUnauthorized, "authorization failed")
+		return
+	}
+
+	opts := &endpoint.WriteOptions{
+		Backends: backendsOverride(r),
+		User:     user,
+	}
+	// for the servers forwarding the caller's credentials
+	opts.Username, opts.Password, _ = credentials(r)
+	if len(opts.Backends) > 0 && !h.canOverride(user) {
+		jsonError(w, http.StatusForbidden, "not allowed to override backends")
+		return
+	}
+
 	queryParams := r.URL.Query()
 
 	// fail early if we're missing the database
@@ -161,58 +333,98 @@ func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		queryParams.Set("rp", h.DefaultRP)
 	}
 
-	// gzip compatible
-	var body = r.Body
+	var ticket *admissionTicket
+	if h.Admission != nil {
+		var pressure float64
+		if h.BackendMgr != nil {
+			pressure = h.BackendMgr.Pressure()
+		}
+		size := r.ContentLength
+		if size < 0 {
+			size = 0
+		}
+		if ticket, ok = h.Admission.admit(queryParams.Get("db"), size, pressure); !ok {
+			h.Admission.throttle(w)
+			return
+		}
+		defer ticket.release()
+	}
 
+	if h.MaxBodySize > 0 && r.ContentLength > h.MaxBodySize {
+		jsonError(w, http.StatusRequestEntityTooLarge, errBodyTooLarge.Error())
+		return
+	}
+	raw := &limitedReader{r: r.Body, max: h.MaxBodySize}
+	var body io.Reader = raw
+
+	// gzip compatible
 	if r.Header.Get("Content-Encoding") == "gzip" {
-		b, err := gzip.NewReader(r.Body)
+		b, err := gzip.NewReader(body)
 		if err != nil {
 			jsonError(w, http.StatusBadRequest, "unable to decode gzip body")
+			return
 		}
 		defer b.Close()
 		body = b
 	}
+	body = &limitedReader{r: body, max: h.MaxDecompressedSize}
+
+	wr := &writeRequest{
+		user: user,
+		db:   queryParams.Get("db"),
+		// the default would be nanosecond if precision isn't specified.
+		precision: queryParams.Get("precision"),
+		start:     start,
+		opts:      opts,
+	}
+	batchSize := h.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
 
-	// read from Body
+	// the body is parsed in sub-batches, and the points are only
+	// relayed once the whole write is within the limits: until
+	// then they are held in memory with the lines they were parsed
+	// from, bounded by max_decompressed_size and max_points
+	reader := bufio.NewReader(body)
 	bodyBuf := getBuf()
-	_, err := bodyBuf.ReadFrom(body)
-	if err != nil {
-		putBuf(bodyBuf)
-		jsonError(w, http.StatusInternalServerError, "Failed reading request body")
-		return
+	defer putBuf(bodyBuf)
+	var line []byte
+	var lines int
+	for {
+		var err error
+		line, err = readLine(reader, h.MaxLineLength, line[:0])
+		if err != nil && err != io.EOF {
+			readError(w, err)
+			return
+		}
+		bodyBuf.Write(line)
+		if len(line) > 0 {
+			lines++
+		}
+		if lines >= batchSize || (err == io.EOF && lines > 0) {
+			if ticket != nil {
+				// chunked bodies are accounted for as read
+				ticket.grow(raw.n)
+			}
+			// the points parsed reference the lines
+			if !h.parse(w, wr, append([]byte(nil), bodyBuf.Bytes()...)) {
+				return
+			}
+			bodyBuf.Reset()
+			lines = 0
+		}
+		if err == io.EOF {
+			break
+		}
 	}
-
-	// the default would be nanosecond if precision isn't specified.
-	precision := queryParams.Get("precision")
-
-	// prep the batch
-	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-		Database:  queryParams.Get("db"),
-		Precision: precision,
-	})
-
-	// parse the points
-	points, err := models.ParsePointsWithPrecision(bodyBuf.Bytes(), start, precision)
-	if err != nil {
-		putBuf(bodyBuf)
-		jsonError(w, http.StatusBadRequest, "failed parsing points")
+	if !h.relay(w, r, wr, batchSize) {
 		return
 	}
 
-	for _, p := range points {
-		bp.AddPoint(client.NewPointFrom(p))
-	}
-
-	// if we have a backend configured, post
-	if h.BackendMgr != nil {
-		err = h.BackendMgr.Post(bp)
-		if err != nil {
-			jsonError(w, http.StatusServiceUnavailable, err.Error())
-		}
+	if wr.dropped > 0 {
+		jsonError(w, http.StatusBadRequest, wr.parseError())
+		return
 	}
-
 	w.WriteHeader(http.StatusNoContent)
-	w.Header().Add("X-InfluxDB-Version", "relay")
-
-	return
 }
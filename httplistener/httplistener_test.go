@@ -30,6 +30,16 @@ func TestNewHTTPfromConfig(t *testing.T) {
 	if h.Timeout != 60 {
 		t.Fatalf("Timeout is incorrect from config")
 	}
+	if h.MaxBodySize != httplistener.DefaultMaxBodySize || h.MaxDecompressedSize != httplistener.DefaultMaxDecompressedSize || h.MaxPoints != httplistener.DefaultMaxPoints {
+		t.Errorf("Expected the default write limits, got %v %v %v", h.MaxBodySize, h.MaxDecompressedSize, h.MaxPoints)
+	}
+
+	// negative limits are removed
+	hc.MaxBodySize, hc.MaxDecompressed, hc.MaxPoints = -1, -1, -1
+	h = httplistener.NewHTTPfromConfig(hc)
+	if h.MaxBodySize != 0 || h.MaxDecompressedSize != 0 || h.MaxPoints != 0 {
+		t.Errorf("Expected no write limits, got %v %v %v", h.MaxBodySize, h.MaxDecompressedSize, h.MaxPoints)
+	}
 }
 
 func TestNewHTTPConfParser(t *testing.T) {
@@ -2,12 +2,14 @@ package httplistener_test
 
 import (
 	"io/ioutil"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/influxdata/influxdb/client/v2"
 	"github.com/sledigabel/sir/httplistener"
+	"github.com/sledigabel/sir/influx-endpoint"
 
 	"net/http"
 )
@@ -17,6 +19,9 @@ import (
 type MockBE struct {
 	Databases []string
 	Points    []client.Point
+	Options   *endpoint.WriteOptions
+	Replay    string
+	Load      float64
 }
 
 func NewMockBE() *MockBE {
@@ -45,10 +50,33 @@ func (mbe *MockBE) Post(bp client.BatchPoints) error {
 	return nil
 }
 
+func (mbe *MockBE) PostWithOptions(bp client.BatchPoints, opts *endpoint.WriteOptions) error {
+	mbe.Options = opts
+	return mbe.Post(bp)
+}
+
 func (mbe *MockBE) Status() []byte {
 	return []byte("{\"mock\":\"active\"}")
 }
 
+func (mbe *MockBE) ReplayBuffer(source, target string) error {
+	mbe.Replay = source + ">" + target
+	return nil
+}
+
+func (mbe *MockBE) StopReplay(source string) error {
+	mbe.Replay = ""
+	return nil
+}
+
+func (mbe *MockBE) Pressure() float64 {
+	return mbe.Load
+}
+
+func (mbe *MockBE) Replays() []byte {
+	return []byte("[]")
+}
+
 func TestSubmitData(t *testing.T) {
 
 	t.Log("Starting server")
@@ -130,3 +158,156 @@ func TestStatus(t *testing.T) {
 	t.Logf("Status: %v", string(body))
 
 }
+
+func TestBackendsOverride(t *testing.T) {
+
+	h := httplistener.NewHTTP()
+	h.Addr = "localhost:19997"
+	h.Users = map[string]string{"admin": "secret", "user": "password"}
+	h.OverrideUsers = []string{"admin"}
+	m := NewMockBE()
+	h.BackendMgr = m
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	go func() {
+		h.Run()
+		wg.Done()
+	}()
+	time.Sleep(time.Second)
+
+	post := func(url, user, password, backends string) int {
+		rq, _ := http.NewRequest("POST", url, strings.NewReader("cpu value=1"))
+		if user != "" {
+			rq.SetBasicAuth(user, password)
+		}
+		if backends != "" {
+			rq.Header.Set("X-Sir-Backends", backends)
+		}
+		resp, err := http.DefaultClient.Do(rq)
+		if err != nil {
+			t.Fatalf("Can't connect to server: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := post("http://localhost:19997/write?db=test", "", "", ""); code != http.StatusUnauthorized {
+		t.Errorf("Anonymous write should be refused: %v", code)
+	}
+	if code := post("http://localhost:19997/write?db=test", "user", "password", "b1"); code != http.StatusForbidden {
+		t.Errorf("Override by user should be forbidden: %v", code)
+	}
+	if code := post("http://localhost:19997/write?db=test", "user", "password", ""); code != http.StatusNoContent {
+		t.Errorf("Write by user should succeed: %v", code)
+	}
+	if m.Options == nil || len(m.Options.Backends) != 0 {
+		t.Errorf("No override expected: %v", m.Options)
+	}
+	if m.Options.User != "user" || m.Options.Username != "user" || m.Options.Password != "password" {
+		t.Errorf("Credentials not passed to the backend: %+v", m.Options)
+	}
+	if code := post("http://localhost:19997/write?db=test", "admin", "secret", "b1, b2"); code != http.StatusNoContent {
+		t.Errorf("Override by admin should succeed: %v", code)
+	}
+	if len(m.Options.Backends) != 2 || m.Options.Backends[1] != "b2" {
+		t.Errorf("Override not passed to the backend: %v", m.Options.Backends)
+	}
+	if code := post("http://localhost:19997/write?db=test&u=admin&p=secret&sir_backends=b3", "", "", ""); code != http.StatusNoContent {
+		t.Errorf("Override by query parameter should succeed: %v", code)
+	}
+	if len(m.Options.Backends) != 1 || m.Options.Backends[0] != "b3" {
+		t.Errorf("Override not passed to the backend: %v", m.Options.Backends)
+	}
+
+	h.Stop()
+	wg.Wait()
+}
+
+func TestReplayAdmin(t *testing.T) {
+
+	h := httplistener.NewHTTP()
+	h.Addr = "localhost:19996"
+	h.Users = map[string]string{"admin": "secret", "user": "password"}
+	h.AdminUsers = []string{"admin"}
+	m := NewMockBE()
+	h.BackendMgr = m
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	go func() {
+		h.Run()
+		wg.Done()
+	}()
+	time.Sleep(time.Second)
+
+	do := func(method, url, user, password string) int {
+		rq, _ := http.NewRequest(method, url, nil)
+		if user != "" {
+			rq.SetBasicAuth(user, password)
+		}
+		resp, err := http.DefaultClient.Do(rq)
+		if err != nil {
+			t.Fatalf("Can't connect to server: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	url := "http://localhost:19996/buffer/replay"
+	if code := do("POST", url+"?source=old&target=new", "", ""); code != http.StatusUnauthorized {
+		t.Errorf("Anonymous replay should be refused: %v", code)
+	}
+	if code := do("POST", url+"?source=old&target=new", "user", "password"); code != http.StatusForbidden {
+		t.Errorf("Replay by user should be forbidden: %v", code)
+	}
+	if code := do("POST", url+"?source=old", "admin", "secret"); code != http.StatusBadRequest {
+		t.Errorf("Replay without target should fail: %v", code)
+	}
+	if code := do("POST", url+"?source=old&target=new", "admin", "secret"); code != http.StatusAccepted {
+		t.Errorf("Replay by admin should succeed: %v", code)
+	}
+	if m.Replay != "old>new" {
+		t.Errorf("Replay not passed to the backend: %v", m.Replay)
+	}
+	if code := do("GET", url, "admin", "secret"); code != http.StatusOK {
+		t.Errorf("Could not list replays: %v", code)
+	}
+	if code := do("DELETE", url+"?source=old", "admin", "secret"); code != http.StatusNoContent || m.Replay != "" {
+		t.Errorf("Could not stop replay: %v", code)
+	}
+
+	h.Stop()
+	wg.Wait()
+}
+
+// startListener runs the listener with a MockBE, returning
+// the backend and the function stopping the listener
+func startListener(t *testing.T, h *httplistener.HTTP) (*MockBE, func()) {
+	m := NewMockBE()
+	h.BackendMgr = m
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	go func() {
+		h.Run()
+		wg.Done()
+	}()
+	time.Sleep(time.Second)
+	return m, func() {
+		h.Stop()
+		wg.Wait()
+	}
+}
+
+// write posts the body to the write endpoint of the
+// listener, returning the response and its body
+func write(t *testing.T, h *httplistener.HTTP, query, body string) (*http.Response, string) {
+	resp, err := http.Post("http://"+h.Addr+"/write?"+query, "", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Can't connect to server: %v", err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp, string(b)
+}
@@ -0,0 +1,306 @@
+package httplistener
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+// Rate limit keys, what writes are counted together
+const (
+	RateLimitByIP       string = "ip"
+	RateLimitByUser     string = "user"
+	RateLimitByDatabase string = "database"
+)
+
+// Rate limit policies, what happens to writes over the limit
+const (
+	RateLimitReject     string = "reject"
+	RateLimitDownsample string = "downsample"
+)
+
+// RateLimitConfig is the struct to map
+// a rate limit from config items
+type RateLimitConfig struct {
+	Name string
+	Key  string
+	// Match restricts the limit to the keys matching it
+	Match           string
+	PointsPerSecond float64 `toml:"points_per_second"`
+	PointsBurst     float64 `toml:"points_burst"`
+	BytesPerSecond  float64 `toml:"bytes_per_second"`
+	BytesBurst      float64 `toml:"bytes_burst"`
+	Policy          string
+}
+
+// tokenBucket holds the points and bytes a key may still write
+type tokenBucket struct {
+	points float64
+	bytes  float64
+	last   time.Time
+}
+
+// RateLimiter applies token buckets, one per key,
+// refilled at the configured rates up to the bursts.
+// A zero rate doesn't limit.
+type RateLimiter struct {
+	Name            string
+	Key             string
+	Match           *regexp.Regexp
+	PointsPerSecond float64
+	PointsBurst     float64
+	BytesPerSecond  float64
+	BytesBurst      float64
+	Policy          string
+
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+	// counters, in points
+	allowed     int64
+	rejected    int64
+	downsampled int64
+	requests    int64
+}
+
+// NewRateLimiterFromConfig creates a rate limiter
+// from a given config struct
+func NewRateLimiterFromConfig(c *RateLimitConfig) (*RateLimiter, error) {
+	l := &RateLimiter{
+		Name:            c.Name,
+		Key:             c.Key,
+		PointsPerSecond: c.PointsPerSecond,
+		PointsBurst:     c.PointsBurst,
+		BytesPerSecond:  c.BytesPerSecond,
+		BytesBurst:      c.BytesBurst,
+		Policy:          c.Policy,
+		buckets:         make(map[string]*tokenBucket),
+	}
+	if l.Name == "" {
+		l.Name = l.Key
+	}
+	switch l.Key {
+	case RateLimitByIP, RateLimitByUser, RateLimitByDatabase:
+	default:
+		return nil, fmt.Errorf("Unknown key %q", l.Key)
+	}
+	switch l.Policy {
+	case "":
+		l.Policy = RateLimitReject
+	case RateLimitReject, RateLimitDownsample:
+	default:
+		return nil, fmt.Errorf("Unknown policy %q", l.Policy)
+	}
+	if l.PointsPerSecond <= 0 && l.BytesPerSecond <= 0 {
+		return nil, fmt.Errorf("No rate")
+	}
+	// the bursts default to a second worth of writes
+	if l.PointsBurst < l.PointsPerSecond {
+		l.PointsBurst = l.PointsPerSecond
+	}
+	if l.BytesBurst < l.BytesPerSecond {
+		l.BytesBurst = l.BytesPerSecond
+	}
+	if c.Match != "" {
+		var err error
+		if l.Match, err = endpoint.CompilePattern(c.Match); err != nil {
+			return nil, fmt.Errorf("Invalid match %q: %v", c.Match, err)
+		}
+	}
+	return l, nil
+}
+
+// newRateLimiters creates the rate limiters,
+// ignoring the invalid ones
+func newRateLimiters(configs []RateLimitConfig) []*RateLimiter {
+	var limiters []*RateLimiter
+	for i := range configs {
+		l, err := NewRateLimiterFromConfig(&configs[i])
+		if err != nil {
+			log.Printf("Ignoring rate limit %v: %v", configs[i].Name, err)
+			continue
+		}
+		limiters = append(limiters, l)
+	}
+	return limiters
+}
+
+// key returns the key of the write for the limiter,
+// false if the limiter doesn't apply
+func (l *RateLimiter) key(r *http.Request, user, db string) (string, bool) {
+	var k string
+	switch l.Key {
+	case RateLimitByIP:
+		k = r.RemoteAddr
+		if host, _, err := net.SplitHostPort(k); err == nil {
+			k = host
+		}
+	case RateLimitByUser:
+		k = user
+	case RateLimitByDatabase:
+		k = db
+	}
+	if l.Match != nil && !l.Match.MatchString(k) {
+		return k, false
+	}
+	return k, true
+}
+
+// bucket returns the bucket of the key, refilled.
+// Must be called with the lock held.
+func (l *RateLimiter) bucket(key string, now time.Time) *tokenBucket {
+	if now.Sub(l.pruned) > time.Minute {
+		// idle buckets would be full anyway
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > time.Minute {
+				delete(l.buckets, k)
+			}
+		}
+		l.pruned = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{points: l.PointsBurst, bytes: l.BytesBurst, last: now}
+		l.buckets[key] = b
+		return b
+	}
+	elapsed := now.Sub(b.last).Seconds()
+	b.points = math.Min(l.PointsBurst, b.points+elapsed*l.PointsPerSecond)
+	b.bytes = math.Min(l.BytesBurst, b.bytes+elapsed*l.BytesPerSecond)
+	b.last = now
+	return b
+}
+
+// fits returns the number of points of a write of the given
+// points and bytes within the tokens of the bucket, and the
+// time to wait for the whole write to fit.
+// Must be called with the lock held.
+func (l *RateLimiter) fits(b *tokenBucket, points int, bytes int) (int, time.Duration) {
+	// the fraction of the write within the limits
+	fraction := 1.0
+	var wait float64
+	if l.PointsPerSecond > 0 && float64(points) > b.points {
+		fraction = math.Max(b.points, 0) / float64(points)
+		wait = (float64(points) - b.points) / l.PointsPerSecond
+	}
+	if l.BytesPerSecond > 0 && float64(bytes) > b.bytes {
+		fraction = math.Min(fraction, math.Max(b.bytes, 0)/float64(bytes))
+		wait = math.Max(wait, (float64(bytes)-b.bytes)/l.BytesPerSecond)
+	}
+	if fraction >= 1 {
+		return points, 0
+	}
+	return int(float64(points) * fraction), time.Duration(wait * float64(time.Second))
+}
+
+// overBurst returns true if a write of the given points
+// and bytes can never fit, even in a full bucket
+func (l *RateLimiter) overBurst(points int, bytes int) bool {
+	return (l.PointsPerSecond > 0 && float64(points) > l.PointsBurst) ||
+		(l.BytesPerSecond > 0 && float64(bytes) > l.BytesBurst)
+}
+
+// consume takes the tokens of the allowed points of a write,
+// limited being set if the limiter downsampled it.
+// Must be called with the lock held.
+func (l *RateLimiter) consume(b *tokenBucket, points, allowed int, bytes int, limited bool) {
+	if points > 0 {
+		b.points -= float64(allowed)
+		b.bytes -= float64(bytes) * float64(allowed) / float64(points)
+	}
+	l.allowed += int64(allowed)
+	if limited {
+		l.downsampled += int64(points - allowed)
+	}
+}
+
+// downsample keeps n of the points, evenly spread
+func downsample(points []models.Point, n int) []models.Point {
+	if n >= len(points) {
+		return points
+	}
+	kept := make([]models.Point, 0, n)
+	for i := 0; i < n; i++ {
+		kept = append(kept, points[i*len(points)/n])
+	}
+	return kept
+}
+
+// limit applies the rate limiters to a whole write. The limiters
+// are all checked before any of them takes its tokens, so that
+// a rejected write costs nothing. It returns the points to relay,
+// or false if the write must be rejected, having answered the
+// request.
+func (h *HTTP) limit(w http.ResponseWriter, r *http.Request, user, db string, points []models.Point, bytes int) ([]models.Point, bool) {
+	now := time.Now()
+	type check struct {
+		l *RateLimiter
+		b *tokenBucket
+		n int
+	}
+	var checks []check
+	// the limiters are locked in order until the tokens are taken
+	defer func() {
+		for _, c := range checks {
+			c.l.lock.Unlock()
+		}
+	}()
+	allowed := len(points)
+	for _, l := range h.RateLimits {
+		key, ok := l.key(r, user, db)
+		if !ok {
+			continue
+		}
+		l.lock.Lock()
+		b := l.bucket(key, now)
+		l.requests++
+		n, wait := l.fits(b, len(points), bytes)
+		checks = append(checks, check{l, b, n})
+		if n < len(points) && l.Policy == RateLimitReject {
+			l.rejected += int64(len(points))
+			if l.overBurst(len(points), bytes) {
+				// waiting would not help
+				jsonError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("write larger than the burst of rate limit %v", l.Name))
+				return nil, false
+			}
+			retry := int(math.Ceil(wait.Seconds()))
+			if retry < 1 {
+				retry = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(retry))
+			jsonError(w, http.StatusTooManyRequests, fmt.Sprintf("rate limit %v exceeded", l.Name))
+			return nil, false
+		}
+		if n < allowed {
+			allowed = n
+		}
+	}
+	for _, c := range checks {
+		c.l.consume(c.b, len(points), allowed, bytes, c.n < len(points))
+	}
+	return downsample(points, allowed), true
+}
+
+// Stats collects statistics from the rate limiter
+func (l *RateLimiter) Stats() (models.Point, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	fields := map[string]interface{}{
+		"requests":    l.requests,
+		"allowed":     l.allowed,
+		"rejected":    l.rejected,
+		"downsampled": l.downsampled,
+		"keys":        len(l.buckets),
+	}
+	tags := models.NewTags(map[string]string{"limiter": l.Name, "key": l.Key})
+	return models.NewPoint("sir_ratelimit", tags, fields, time.Now())
+}
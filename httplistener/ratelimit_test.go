@@ -0,0 +1,63 @@
+package httplistener_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/sledigabel/sir/httplistener"
+)
+
+func TestRateLimits(t *testing.T) {
+
+	h := httplistener.NewHTTP()
+	h.Addr = "localhost:19994"
+	for _, c := range []httplistener.RateLimitConfig{
+		{Name: "all", Key: "ip", PointsPerSecond: 0.1, PointsBurst: 100},
+		{Name: "strict", Key: "database", Match: "strict", PointsPerSecond: 0.1, PointsBurst: 2},
+		{Name: "sampled", Key: "database", Match: "sampled", PointsPerSecond: 0.1, PointsBurst: 3, Policy: "downsample"},
+	} {
+		l, err := httplistener.NewRateLimiterFromConfig(&c)
+		if err != nil {
+			t.Fatalf("Could not create rate limiter: %v", err)
+		}
+		h.RateLimits = append(h.RateLimits, l)
+	}
+	if _, err := httplistener.NewRateLimiterFromConfig(&httplistener.RateLimitConfig{Key: "host", PointsPerSecond: 1}); err == nil {
+		t.Errorf("Expected an unknown key to fail")
+	}
+	m, stop := startListener(t, h)
+	defer stop()
+
+	if resp, _ := write(t, h, "db=strict", "cpu value=1\ncpu value=2"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Write within the burst should succeed: %v", resp.StatusCode)
+	}
+	if resp, _ := write(t, h, "db=strict", "cpu value=3"); resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("Write over the limit should be rejected: %v %v", resp.StatusCode, resp.Header)
+	}
+	if resp, _ := write(t, h, "db=strict", "cpu value=1\ncpu value=2\ncpu value=3"); resp.StatusCode != http.StatusRequestEntityTooLarge || resp.Header.Get("Retry-After") != "" {
+		t.Errorf("Write over the burst should be rejected for good: %v %v", resp.StatusCode, resp.Header)
+	}
+	if resp, _ := write(t, h, "db=other", "cpu value=4\ncpu value=5\ncpu value=6"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Write without limit should succeed: %v", resp.StatusCode)
+	}
+	if resp, _ := write(t, h, "db=sampled", "cpu value=1\ncpu value=2\ncpu value=3\ncpu value=4\ncpu value=5"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Write over the limit should be downsampled: %v", resp.StatusCode)
+	}
+	if len(m.Points) != 8 {
+		t.Errorf("Expected 8 points relayed, got %v", len(m.Points))
+	}
+
+	pts, err := h.Stats()
+	if err != nil || len(pts) != 3 {
+		t.Fatalf("Could not get stats: %v %v", pts, err)
+	}
+	// the rejected writes take no tokens from the other limiters
+	expected := map[string][2]int64{"all": {8, 0}, "strict": {2, 0}, "sampled": {3, 2}}
+	for _, pt := range pts {
+		fields, _ := pt.Fields()
+		e := expected[pt.Tags().GetString("limiter")]
+		if fields["allowed"] != e[0] || fields["downsampled"] != e[1] {
+			t.Errorf("Wrong stats for %v: %v", pt.Tags().GetString("limiter"), fields)
+		}
+	}
+}
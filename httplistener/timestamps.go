@@ -0,0 +1,161 @@
+package httplistener
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+// Actions on the points out of the time bounds
+const (
+	TimestampDrop   string = "drop"
+	TimestampClamp  string = "clamp"
+	TimestampReject string = "reject"
+)
+
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// TimestampBoundsConfig is the struct to map
+// the time bounds of points from config items
+type TimestampBoundsConfig struct {
+	// Database restricts the bounds to the
+	// matching databases, all of them if empty
+	Database  string
+	MaxAge    duration `toml:"max_age"`
+	MaxFuture duration `toml:"max_future"`
+	Action    string
+}
+
+// TimestampBounds catches the points dated too far in the
+// past or in the future, typically from broken clocks,
+// that backends would reject and buffers keep forever.
+// Zero bounds don't apply.
+type TimestampBounds struct {
+	Dropped   uint64
+	Clamped   uint64
+	Rejected  uint64
+	Name      string
+	Database  *regexp.Regexp
+	MaxAge    time.Duration
+	MaxFuture time.Duration
+	Action    string
+}
+
+// NewTimestampBoundsFromConfig creates
+// time bounds from a given config struct
+func NewTimestampBoundsFromConfig(c *TimestampBoundsConfig) (*TimestampBounds, error) {
+	tb := &TimestampBounds{
+		Name:      c.Database,
+		MaxAge:    c.MaxAge.Duration,
+		MaxFuture: c.MaxFuture.Duration,
+		Action:    c.Action,
+	}
+	if tb.Name == "" {
+		tb.Name = "default"
+	}
+	switch tb.Action {
+	case "":
+		tb.Action = TimestampDrop
+	case TimestampDrop, TimestampClamp, TimestampReject:
+	default:
+		return nil, fmt.Errorf("Unknown action %q", tb.Action)
+	}
+	if c.Database != "" {
+		var err error
+		if tb.Database, err = endpoint.CompilePattern(c.Database); err != nil {
+			return nil, fmt.Errorf("Invalid database %q: %v", c.Database, err)
+		}
+	}
+	return tb, nil
+}
+
+// newTimestampBounds creates the time bounds,
+// ignoring the invalid ones
+func newTimestampBounds(configs []TimestampBoundsConfig) []*TimestampBounds {
+	var bounds []*TimestampBounds
+	for i := range configs {
+		tb, err := NewTimestampBoundsFromConfig(&configs[i])
+		if err != nil {
+			log.Printf("Ignoring timestamp bounds %v: %v", configs[i].Database, err)
+			continue
+		}
+		bounds = append(bounds, tb)
+	}
+	return bounds
+}
+
+// timestampBounds returns the first bounds
+// applying to the database, nil if none
+func (h *HTTP) timestampBounds(db string) *TimestampBounds {
+	for _, tb := range h.Timestamps {
+		if tb.Database == nil || tb.Database.MatchString(db) {
+			return tb
+		}
+	}
+	return nil
+}
+
+// violation returns why the time of the point,
+// received at now, is out of bounds, if it is
+func (tb *TimestampBounds) violation(t, now time.Time) string {
+	if tb.MaxAge > 0 && now.Sub(t) > tb.MaxAge {
+		return fmt.Sprintf("older than %v", tb.MaxAge)
+	}
+	if tb.MaxFuture > 0 && t.Sub(now) > tb.MaxFuture {
+		return fmt.Sprintf("more than %v in the future", tb.MaxFuture)
+	}
+	return ""
+}
+
+// filter applies the bounds to the points of a write received
+// at now. It returns the points to relay, and the error if the
+// write must be rejected. Dropped and clamped points are
+// reported to wr.
+func (tb *TimestampBounds) filter(points []models.Point, now time.Time, wr *writeRequest) ([]models.Point, error) {
+	kept := points[:0]
+	for _, p := range points {
+		reason := tb.violation(p.Time(), now)
+		if reason == "" {
+			kept = append(kept, p)
+			continue
+		}
+		switch tb.Action {
+		case TimestampReject:
+			atomic.AddUint64(&tb.Rejected, 1)
+			return nil, fmt.Errorf("point out of time bounds '%v': %v", p.String(), reason)
+		case TimestampClamp:
+			atomic.AddUint64(&tb.Clamped, 1)
+			wr.clamped++
+			p.SetTime(now)
+			kept = append(kept, p)
+		default:
+			atomic.AddUint64(&tb.Dropped, 1)
+			wr.drop(fmt.Sprintf("point out of time bounds '%v': %v", p.String(), reason))
+		}
+	}
+	return kept, nil
+}
+
+// Stats collects statistics from the time bounds
+func (tb *TimestampBounds) Stats() (models.Point, error) {
+	fields := map[string]interface{}{
+		"dropped":  int64(atomic.LoadUint64(&tb.Dropped)),
+		"clamped":  int64(atomic.LoadUint64(&tb.Clamped)),
+		"rejected": int64(atomic.LoadUint64(&tb.Rejected)),
+	}
+	tags := models.NewTags(map[string]string{"bounds": tb.Name})
+	return models.NewPoint("sir_timestamps", tags, fields, time.Now())
+}
@@ -0,0 +1,73 @@
+package httplistener_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sledigabel/sir/httplistener"
+)
+
+func TestTimestampBounds(t *testing.T) {
+
+	h := httplistener.NewHTTP()
+	h.Addr = "localhost:19987"
+	hc, err := httplistener.NewHTTPParseConfig(`
+[listener]
+	[[listener.timestamps]]
+		database = "clamped"
+		max_future = "1h"
+		action = "clamp"
+	[[listener.timestamps]]
+		database = "strict"
+		max_age = "24h"
+		action = "reject"
+	[[listener.timestamps]]
+		max_age = "24h"
+`)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	h.Timestamps = httplistener.NewHTTPfromConfig(hc).Timestamps
+	h.BatchSize = 1
+	if len(h.Timestamps) != 3 {
+		t.Fatalf("Expected 3 time bounds, got %v", len(h.Timestamps))
+	}
+	m, stop := startListener(t, h)
+	defer stop()
+
+	resp, body := write(t, h, "db=test", "cpu value=1 0\ncpu value=2")
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "partial write: point out of time bounds") || !strings.Contains(body, "dropped=1") {
+		t.Errorf("Expected a partial write, got %v %v", resp.StatusCode, body)
+	}
+	if len(m.Points) != 1 {
+		t.Fatalf("Expected 1 point relayed, got %v", len(m.Points))
+	}
+	if resp, body = write(t, h, "db=clamped", "cpu value=1 4102444800000000000"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected the point to be clamped, got %v %v", resp.StatusCode, body)
+	}
+	if len(m.Points) != 2 || time.Since(m.Points[1].Time()) > time.Minute {
+		t.Errorf("Expected a point clamped to now, got %v", m.Points)
+	}
+	resp, body = write(t, h, "db=clamped", "cpu value=1 4102444800000000000\ncpu value=")
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "dropped=1 clamped=1") {
+		t.Errorf("Expected the clamped point in the partial write, got %v %v", resp.StatusCode, body)
+	}
+	if resp, body = write(t, h, "db=strict", "cpu value=1\ncpu value=1 0"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected the write to be rejected, got %v %v", resp.StatusCode, body)
+	}
+	// rejected before the first sub-batch is relayed
+	if len(m.Points) != 3 {
+		t.Errorf("Expected no point relayed, got %v", len(m.Points))
+	}
+
+	pts, err := h.Stats()
+	if err != nil || len(pts) != 3 {
+		t.Fatalf("Could not get stats: %v %v", pts, err)
+	}
+	fields, _ := pts[2].Fields()
+	if fields["dropped"] != int64(1) {
+		t.Errorf("Wrong stats: %v", fields)
+	}
+}
@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
 )
 
+// jsonError answers an error the way Influx does
 func jsonError(w http.ResponseWriter, code int, message string) {
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Influxdb-Error", message)
 	data := fmt.Sprintf("{\"error\":%q}\n", message)
 	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
 	w.WriteHeader(code)
@@ -28,3 +31,24 @@ func putBuf(b *bytes.Buffer) {
 	b.Reset()
 	bufPool.Put(b)
 }
+
+// credentials extracts the influx credentials from a request:
+// u and p query parameters, basic auth or a token header
+// in the form "Token username:password".
+func credentials(r *http.Request) (string, string, bool) {
+	q := r.URL.Query()
+	if u := q.Get("u"); u != "" {
+		return u, q.Get("p"), true
+	}
+	if u, p, ok := r.BasicAuth(); ok {
+		return u, p, true
+	}
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Token ") {
+		creds := strings.SplitN(strings.TrimPrefix(auth, "Token "), ":", 2)
+		if len(creds) == 2 {
+			return creds[0], creds[1], true
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,134 @@
+package endpoint
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// bufferLockFile is locked by the process using a buffer
+const bufferLockFile = "lock"
+
+// ErrBufferLocked is returned when a buffer
+// is in use by another process
+var ErrBufferLocked = errors.New("buffer in use by another process")
+
+// openLockFile opens the lock file of the buffer in dir.
+// Read-only, it is not created: nil is returned when
+// no process ever opened the buffer for writing.
+func openLockFile(dir string, readOnly bool) (*os.File, error) {
+	flags := os.O_CREATE | os.O_RDWR
+	if readOnly {
+		flags = os.O_RDWR
+	}
+	f, err := os.OpenFile(filepath.Join(dir, bufferLockFile), flags, 0644)
+	if readOnly && os.IsNotExist(err) {
+		return nil, nil
+	}
+	return f, err
+}
+
+// lock prevents other processes from opening the buffer,
+// so that offline tools never run against a live relay.
+func (b *Bufferer) lock() error {
+	f, err := openLockFile(b.RootPath, b.ReadOnly)
+	if f == nil || err != nil {
+		return err
+	}
+	if err = lockFile(f); err != nil {
+		f.Close()
+		return fmt.Errorf("%v: %v", b.RootPath, ErrBufferLocked)
+	}
+	b.lockFile = f
+	return nil
+}
+
+// unlock releases the lock taken by lock
+func (b *Bufferer) unlock() {
+	if b.lockFile != nil {
+		b.lockFile.Close()
+		b.lockFile = nil
+	}
+}
+
+// BufferFilter selects buffered records.
+// Empty fields match every record.
+type BufferFilter struct {
+	Database        string
+	RetentionPolicy string
+	// Before matches the records buffered before that time
+	Before time.Time
+}
+
+// Match returns true if the record matches the filter
+func (f *BufferFilter) Match(bf *BufferFile) bool {
+	if f.Database != "" && f.Database != bf.Database {
+		return false
+	}
+	if f.RetentionPolicy != "" && f.RetentionPolicy != bf.RetentionPolicy {
+		return false
+	}
+	if !f.Before.IsZero() && !bf.Timestamp.Before(f.Before) {
+		return false
+	}
+	return true
+}
+
+// Each calls fn with the buffered batches, oldest first,
+// without removing them. Corrupt records are skipped.
+func (b *Bufferer) Each(fn func(bf *BufferFile, bp client.BatchPoints) error) error {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	for _, bf := range b.Index {
+		bp, err := b.read(bf)
+		if err == errCorruptRecord || err == errTruncatedRecord {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(bf, bp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Purge removes the records matching the filter.
+// The other records are moved at the end of the log,
+// as is and in order. Returns the number of points removed.
+func (b *Bufferer) Purge(f *BufferFilter) (int, error) {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	if b.log == nil {
+		return 0, fmt.Errorf("Bufferer %v not initialised", b.RootPath)
+	}
+	var removed int
+	for n := len(b.Index); n > 0; n-- {
+		bf := b.Index[0]
+		if f.Match(bf) {
+			removed += bf.NumMetrics
+		} else {
+			// a record that can't be read is kept
+			// in place, not purged with the others
+			rec, err := b.log.Read(bf)
+			if err != nil {
+				return removed, fmt.Errorf("Unable to read record of %v at %v: %v", bf.Filename, bf.Offset, err)
+			}
+			kept, err := b.log.Append(rec)
+			if err != nil {
+				return removed, err
+			}
+			b.Index = append(b.Index, kept)
+			b.account(kept, 1)
+		}
+		if err := b.release(); err != nil {
+			return removed, err
+		}
+	}
+	return removed, b.log.Checkpoint()
+}
@@ -0,0 +1,171 @@
+package endpoint_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+func TestBufferPurge(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := newTestBufferer(t, dir)
+	for _, db := range []string{"billing", "debug", "billing", "debug"} {
+		bp := createBatch()
+		bp.SetDatabase(db)
+		if err := b.Write(bp); err != nil {
+			t.Fatalf("Could not Write batch: %v", err)
+		}
+	}
+
+	n, err := b.Purge(&endpoint.BufferFilter{Database: "debug"})
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 points purged, got %v (%v)", n, err)
+	}
+	// nothing is buffered that long ago
+	n, err = b.Purge(&endpoint.BufferFilter{Before: time.Now().Add(-time.Hour)})
+	if err != nil || n != 0 {
+		t.Fatalf("Expected no points purged, got %v (%v)", n, err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Could not close: %v", err)
+	}
+
+	b = newTestBufferer(t, dir)
+	var dbs []string
+	err = b.Each(func(bf *endpoint.BufferFile, bp client.BatchPoints) error {
+		dbs = append(dbs, bp.Database())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Could not read buffer: %v", err)
+	}
+	if len(dbs) != 2 || dbs[0] != "billing" || dbs[1] != "billing" {
+		t.Errorf("Expected the billing batches to be kept, got %v", dbs)
+	}
+	if len(b.Index) != 2 {
+		t.Errorf("Each removed records")
+	}
+
+	n, err = b.Purge(&endpoint.BufferFilter{})
+	if err != nil || n != 2 || len(b.Index) != 0 {
+		t.Errorf("Expected the whole buffer to be purged, got %v (%v)", n, err)
+	}
+}
+
+func TestBufferPurgeUnreadable(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	shared, buffers := newSharedBufferers(t, dir)
+	defer shared.Close()
+	b := buffers[0]
+	for _, db := range []string{"debug", "billing"} {
+		bp := namedBatch(db)
+		bp.SetDatabase(db)
+		if err := b.Write(bp); err != nil {
+			t.Fatalf("Could not Write batch: %v", err)
+		}
+	}
+	blobs, _ := filepath.Glob(filepath.Join(shared.RootPath, "??", "*"))
+	for _, blob := range blobs {
+		os.Remove(blob)
+	}
+
+	if _, err := b.Purge(&endpoint.BufferFilter{Database: "debug"}); err == nil {
+		t.Errorf("Expected an error for the unreadable billing record")
+	}
+	if len(b.Index) != 1 || b.Index[0].Database != "billing" {
+		t.Errorf("Expected the billing record to be kept, got %v", b.Index)
+	}
+}
+
+// snapshot returns the size and modification time of the files in dir
+func snapshot(t *testing.T, dir string) map[string]string {
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		files[path] = fmt.Sprintf("%v %v", info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Could not list %v: %v", dir, err)
+	}
+	return files
+}
+
+func TestBufferReadOnly(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	shared, buffers := newSharedBufferers(t, dir)
+	for i := 0; i < 2; i++ {
+		if err := buffers[0].Write(createBatch()); err != nil {
+			t.Fatalf("Could not Write batch: %v", err)
+		}
+	}
+	for _, b := range buffers {
+		b.Close()
+	}
+	shared.Close()
+	before := snapshot(t, dir)
+
+	shared = endpoint.NewSharedBuffer(filepath.Join(dir, "shared"))
+	shared.ReadOnly = true
+	b := endpoint.NewBufferer()
+	b.RootPath = filepath.Join(dir, "a")
+	b.ReadOnly = true
+	if err := shared.Attach(b); err != nil {
+		t.Fatalf("Could not attach Bufferer: %v", err)
+	}
+	if err := b.Init(); err != nil {
+		t.Fatalf("Could not init Bufferer: %v", err)
+	}
+	var points int
+	err = b.Each(func(bf *endpoint.BufferFile, bp client.BatchPoints) error {
+		if bf.Shared == 0 {
+			t.Errorf("Expected the body in a shared blob")
+		}
+		points += len(bp.Points())
+		return nil
+	})
+	if err != nil || points != 2 {
+		t.Errorf("Expected 2 points, got %v (%v)", points, err)
+	}
+	if err := b.Write(createBatch()); err == nil {
+		t.Errorf("Write to a read-only buffer should fail")
+	}
+	b.Close()
+	shared.Close()
+
+	after := snapshot(t, dir)
+	if len(after) != len(before) {
+		t.Errorf("Expected the files to be kept, got %v for %v", after, before)
+	}
+	for path, state := range before {
+		if after[path] != state {
+			t.Errorf("Expected %v to be left as is, got %v for %v", path, after[path], state)
+		}
+	}
+}
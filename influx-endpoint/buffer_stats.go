@@ -0,0 +1,113 @@
+package endpoint
+
+import (
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// bufferKey identifies the batches of
+// a database and retention policy
+type bufferKey struct {
+	db, rp string
+}
+
+// replayCounter tracks the points
+// replayed for a bufferKey
+type replayCounter struct {
+	replayed   uint64
+	last       uint64
+	throughput float64
+}
+
+// delivered accounts for a record written to the backend.
+// Must be called with the lock held.
+func (b *Bufferer) delivered(bf *BufferFile) {
+	if b.replay == nil {
+		b.replay = make(map[bufferKey]*replayCounter)
+	}
+	k := bufferKey{bf.Database, bf.RetentionPolicy}
+	c, ok := b.replay[k]
+	if !ok {
+		c = &replayCounter{}
+		b.replay[k] = c
+	}
+	c.replayed += uint64(bf.NumMetrics)
+}
+
+// dbStats returns a sir_relaybuffer point per database
+// and retention policy, with the time left to drain
+// the backlog at the current replay throughput.
+// Must be called with the lock held.
+func (b *Bufferer) dbStats(now time.Time) []models.Point {
+	type backlog struct {
+		records, points int
+		bytes           int64
+		oldest, newest  time.Time
+	}
+	backlogs := make(map[bufferKey]*backlog)
+	var keys []bufferKey
+	for _, bf := range b.Index {
+		k := bufferKey{bf.Database, bf.RetentionPolicy}
+		bl, ok := backlogs[k]
+		if !ok {
+			bl = &backlog{oldest: bf.Timestamp}
+			backlogs[k] = bl
+			keys = append(keys, k)
+		}
+		bl.records++
+		bl.points += bf.NumMetrics
+		bl.bytes += bf.Size + bf.Shared
+		bl.newest = bf.Timestamp
+	}
+
+	// throughput since the last collection
+	elapsed := now.Sub(b.statsTime).Seconds()
+	for k, c := range b.replay {
+		if !b.statsTime.IsZero() && elapsed > 0 {
+			c.throughput = float64(c.replayed-c.last) / elapsed
+		}
+		c.last = c.replayed
+		if _, ok := backlogs[k]; !ok {
+			if c.throughput == 0 {
+				// nothing left to report on
+				delete(b.replay, k)
+				continue
+			}
+			backlogs[k] = &backlog{}
+			keys = append(keys, k)
+		}
+	}
+	b.statsTime = now
+
+	var pts []models.Point
+	for _, k := range keys {
+		bl := backlogs[k]
+		fields := map[string]interface{}{
+			"records":     bl.records,
+			"num_metrics": bl.points,
+			"bytes":       bl.bytes,
+		}
+		if bl.records > 0 {
+			fields["oldest"] = bl.oldest.UnixNano()
+			fields["newest"] = bl.newest.UnixNano()
+			fields["lag_ns"] = int64(now.Sub(bl.oldest))
+		}
+		if c, ok := b.replay[k]; ok {
+			fields["replayed"] = int64(c.replayed)
+			fields["throughput"] = c.throughput
+			if c.throughput > 0 {
+				fields["eta_ns"] = int64(float64(bl.points) / c.throughput * float64(time.Second))
+			}
+		}
+		tags := models.NewTags(map[string]string{
+			"database":         k.db,
+			"retention_policy": k.rp,
+		})
+		pt, err := models.NewPoint("sir_relaybuffer", tags, fields, now)
+		if err == nil {
+			pts = append(pts, pt)
+		}
+	}
+	return pts
+}
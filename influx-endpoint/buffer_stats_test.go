@@ -0,0 +1,64 @@
+package endpoint_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBufferStatsPerDatabase(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := newTestBufferer(t, dir)
+	for _, db := range []string{"billing", "billing", "debug"} {
+		bp := createBatch()
+		bp.SetDatabase(db)
+		if err := b.Write(bp); err != nil {
+			t.Fatalf("Could not Write batch: %v", err)
+		}
+	}
+	b.Stats()
+	time.Sleep(50 * time.Millisecond)
+	if bp, err := b.Pop(); err != nil || bp.Database() != "billing" {
+		t.Fatalf("Could not pop: %v", err)
+	}
+
+	pts, err := b.Stats()
+	if err != nil {
+		t.Fatalf("Could not get stats: %v", err)
+	}
+	stats := make(map[string]map[string]interface{})
+	for _, pt := range pts {
+		if db := pt.Tags().GetString("database"); db != "" {
+			stats[db], _ = pt.Fields()
+		}
+	}
+	if len(stats) != 2 {
+		t.Fatalf("Expected stats for 2 databases, got %v", stats)
+	}
+	billing := stats["billing"]
+	if billing["records"] != int64(1) || billing["num_metrics"] != int64(1) || billing["bytes"].(int64) <= 0 {
+		t.Errorf("Wrong backlog stats: %v", billing)
+	}
+	if billing["replayed"] != int64(1) || billing["throughput"].(float64) <= 0 {
+		t.Errorf("Wrong replay stats: %v", billing)
+	}
+	if _, ok := billing["eta_ns"]; !ok {
+		t.Errorf("Missing time to drain: %v", billing)
+	}
+	if billing["oldest"].(int64) > billing["newest"].(int64) || billing["lag_ns"].(int64) <= 0 {
+		t.Errorf("Wrong timestamps: %v", billing)
+	}
+	if _, ok := stats["debug"]["eta_ns"]; ok {
+		t.Errorf("No time to drain without replay: %v", stats["debug"])
+	}
+	if stats["debug"]["records"] != int64(1) {
+		t.Errorf("Wrong backlog stats: %v", stats["debug"])
+	}
+}
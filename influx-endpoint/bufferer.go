@@ -1,43 +1,124 @@
 package endpoint
 
 import (
-	"compress/zlib"
-	"encoding/json"
+	"bytes"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/influxdata/influxdb/models"
 
 	"github.com/influxdata/influxdb/client/v2"
-	"github.com/segmentio/ksuid"
 )
 
 var bufferSizeMax = 10000
 
-// BufferFile is the struct describing a batch as a buffer
+// DefaultCheckpointFrequency is how often
+// the buffer read position is saved by default
+const DefaultCheckpointFrequency = 10 * time.Second
+
+// BufferFile is the struct describing a batch as a buffer.
+// Batches are stored as records in the segment Filename.
 type BufferFile struct {
-	Filename        string `json:"filename"`
-	NumMetrics      int    `json:"num_metrics"`
-	Database        string `json:"database"`
-	RetentionPolicy string `json:"retention_policy"`
-	Precision       string `json:"precision"`
+	Filename        string    `json:"filename"`
+	Segment         uint64    `json:"segment"`
+	Offset          int64     `json:"offset"`
+	Size            int64     `json:"size"`
+	NumMetrics      int       `json:"num_metrics"`
+	Database        string    `json:"database"`
+	RetentionPolicy string    `json:"retention_policy"`
+	Precision       string    `json:"precision"`
+	Timestamp       time.Time `json:"timestamp"`
+	KeyID           string    `json:"key_id,omitempty"`
+	// Blob names the body kept by the shared buffer,
+	// Shared being its size
+	Blob   string `json:"blob,omitempty"`
+	Shared int64  `json:"shared,omitempty"`
 }
 
 // Bufferer is the main buffering struct
 type Bufferer struct {
-	Input          chan client.BatchPoints
-	Output         chan client.BatchPoints
-	Index          []*BufferFile
-	RootPath       string
+	// points dropped by the limits, first
+	// for the alignment of atomic operations
+	Evicted  uint64
+	Dropped  uint64
+	Rejected uint64
+	Expired  uint64
+	// Refused counts the points replayed that the backend refused
+	Refused uint64
+	// Spilled counts the flushes forced by a full queue
+	Spilled uint64
+	// time spent by writers waiting on the Bufferer, in ns
+	BlockedTime    int64
+	MaxBlockedTime int64
+	// latency of the fsync calls
+	syncs syncStats
+
+	Input  chan client.BatchPoints
+	Output chan client.BatchPoints
+	// HighWaterMark is the queue length past which
+	// writers flush the queue to disk themselves
+	HighWaterMark int
+	// FlushSize is the queue length triggering a flush
+	FlushSize int
+	Index     []*BufferFile
+	RootPath  string
+	// Type is either disk or memory
+	Type           string
 	FlushFrequency time.Duration
-	Compression    bool
-	Shutdown       chan struct{}
-	Lock           sync.Mutex
+	// CheckpointFrequency is how often the read position is saved
+	CheckpointFrequency time.Duration
+	// Codec compresses the new records, at CompressionLevel
+	Codec            byte
+	CompressionLevel int
+	// Keyring encrypts the records when set,
+	// it is loaded by Init from the key sources
+	Keyring            *BufferKeyring
+	KeySource          string
+	PreviousKeySources []string
+	// Sync is the buffer sync mode of the disk buffers
+	Sync        string
+	SegmentSize int64
+	Limits      BufferLimits
+	Policy      string
+	// Budget is shared by all the buffers of the relay
+	Budget *BufferBudget
+	// Shared stores the bodies of the records once
+	// for all the disk buffers attached to it
+	Shared *SharedBuffer
+	// ReadOnly loads an existing disk buffer without
+	// writing to it, for the tools inspecting it
+	ReadOnly bool
+	Shutdown chan struct{}
+	Lock     sync.Mutex
+	// flushLock keeps the batches in order between flushes
+	flushLock sync.Mutex
+	flush     chan struct{}
+	log       recordStore
+	lowDisk   uint32
+	// records found corrupt when read
+	corrupted uint64
+	lockFile  *os.File
+	// points replayed per database and retention policy
+	replay    map[bufferKey]*replayCounter
+	statsTime time.Time
+	// unread bytes and points, shared
+	// counting the bytes held by Shared
+	bytes    int64
+	points   int64
+	shared   int64
+	reported struct {
+		bytes, points, files int64
+	}
+	// bytes and points accepted by Add under
+	// the reject policy, waiting on Input
+	queued struct {
+		bytes, points int64
+	}
 }
 
 // BatchBuffer is the marshalling struct for batches
@@ -55,30 +136,38 @@ func NewBatchBufferFromBP(bp client.BatchPoints) *BatchBuffer {
 		Precision:       bp.Precision(),
 		RetentionPolicy: bp.RetentionPolicy(),
 	}
-	for i, p := range bp.Points() {
-		if i == 0 {
-			bb.Points = p.String()
-		} else {
-			bb.Points = fmt.Sprintf("%s\n%s", bb.Points, p.String())
-		}
-	}
+	bb.Points = string(bytes.TrimSuffix(encodePoints(bp), []byte{'\n'}))
 	return &bb
 }
 
 // BatchPoints converts a BatchBuffer into a batch
 func (b *BatchBuffer) BatchPoints() (client.BatchPoints, error) {
+	return decodePoints(b.Database, b.RetentionPolicy, b.Precision, []byte(b.Points))
+}
 
+// encodePoints returns the line protocol of the batch points
+func encodePoints(bp client.BatchPoints) []byte {
+	var buf bytes.Buffer
+	for _, p := range bp.Points() {
+		buf.WriteString(p.String())
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// decodePoints creates a batch from line protocol
+func decodePoints(db, rp, precision string, body []byte) (client.BatchPoints, error) {
 	bpc := client.BatchPointsConfig{
-		Precision:       b.Precision,
-		Database:        b.Database,
-		RetentionPolicy: b.RetentionPolicy,
+		Precision:       precision,
+		Database:        db,
+		RetentionPolicy: rp,
 	}
 	bp, err := client.NewBatchPoints(bpc)
 	if err != nil {
 		return bp, err
 	}
 	var pts []models.Point
-	pts, err = models.ParsePointsString(b.Points)
+	pts, err = models.ParsePoints(body)
 	for _, p := range pts {
 		bp.AddPoint(client.NewPointFrom(p))
 	}
@@ -90,21 +179,6 @@ func NewBufferFile() *BufferFile {
 	return &BufferFile{}
 }
 
-// NewBufferFileFromBP creates a BufferFile from a batch
-func NewBufferFileFromBP(bp client.BatchPoints) *BufferFile {
-
-	id := ksuid.New()
-	bf := BufferFile{
-		Database:        bp.Database(),
-		RetentionPolicy: bp.RetentionPolicy(),
-		Precision:       bp.Precision(),
-		NumMetrics:      len(bp.Points()),
-		Filename:        id.String(),
-	}
-
-	return &bf
-}
-
 func (bf *BufferFile) String() string {
 	return fmt.Sprintf("%s-%s-%s", bf.Database, bf.RetentionPolicy, bf.Precision)
 }
@@ -114,60 +188,75 @@ func NewBufferer() *Bufferer {
 	b := Bufferer{}
 	b.Index = make([]*BufferFile, 0)
 	b.RootPath, _ = os.Getwd()
-	b.Input = make(chan client.BatchPoints, bufferSizeMax)
+	b.SetQueueSize(bufferSizeMax)
+	b.flush = make(chan struct{}, 1)
 	b.FlushFrequency = 5 * time.Minute
+	b.CheckpointFrequency = DefaultCheckpointFrequency
 	b.Shutdown = make(chan struct{})
-	b.Compression = false
+	b.Codec = CodecNone
+	b.Type = BufferTypeDisk
+	b.SegmentSize = DefaultSegmentSize
+	b.Policy = BufferPolicyDropOldest
+	b.Sync = BufferSyncNone
 	return &b
 }
 
-// BufferSave is the marshalling struct for Bufferers
-type BufferSave struct {
-	Index []*BufferFile `json:"bufferfiles"`
-}
-
-// SaveIndex marshalls a buffer into a file
+// SaveIndex persists the read position of the buffer.
+// It runs periodically so that a crash only replays
+// the batches popped since the last checkpoint.
 func (b *Bufferer) SaveIndex() error {
-
-	bs := BufferSave{
-		Index: b.Index,
-	}
-	bytes, err := json.Marshal(bs)
-	if err != nil {
-		return err
-	}
-	fd, err := os.Create(filepath.Join(b.RootPath, "index.json"))
-	if err != nil {
-		return err
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	if b.log == nil {
+		return nil
 	}
-	defer fd.Close()
-	fd.Write(bytes)
-	return nil
+	return b.log.Checkpoint()
 }
 
-// LoadIndex loads up a previously saved Buffer and unmarshalls it
+// LoadIndex rebuilds the index by scanning the segments
+// from the last saved read position.
+// Batch files left by older versions are moved into the log.
 func (b *Bufferer) LoadIndex() error {
-	var bs BufferSave
-	if _, err := os.Stat(filepath.Join(b.RootPath, "index.json")); err != nil {
-		b.Index = make([]*BufferFile, 0)
-		return nil
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	if b.Type == BufferTypeMemory {
+		b.log = newMemoryStore()
+	} else {
+		l := newSegmentLog(b.RootPath, b.SegmentSize)
+		l.syncMode, l.syncs = b.Sync, &b.syncs
+		l.readOnly = b.ReadOnly
+		b.log = l
+		if b.Shared != nil {
+			b.log = newSharedStore(l, b.Shared, b.RootPath, l.durable())
+		}
 	}
-	fd, err := os.Open(filepath.Join(b.RootPath, "index.json"))
+	index, err := b.log.Open()
 	if err != nil {
 		return err
 	}
-	bytes, err := ioutil.ReadAll(fd)
-	if err != nil {
-		return err
+	if n := b.log.Corrupt(); n > 0 {
+		log.Printf("Skipped %v corrupt records in %v", n, b.RootPath)
 	}
-	if err = json.Unmarshal(bytes, &bs); err != nil {
+	b.Index = append(make([]*BufferFile, 0, len(index)), index...)
+	if err = b.checkKeys(); err != nil {
+		b.log.Close()
+		b.log = nil
 		return err
 	}
-	b.Index = bs.Index
-	// successful load, deleting index.json
-	os.Remove(filepath.Join(b.RootPath, "index.json"))
-	return nil
+	b.bytes, b.points, b.shared = 0, 0, 0
+	for _, bf := range b.Index {
+		b.account(bf, 1)
+	}
+	b.syncBudget()
+	if b.Type == BufferTypeMemory || b.ReadOnly {
+		return nil
+	}
 
+	n, err := b.recoverLegacyFiles()
+	if n > 0 {
+		log.Printf("Recovered %v buffer files in %v", n, b.RootPath)
+	}
+	return err
 }
 
 // Init creates the Bufferer directory if needed and tests
@@ -175,20 +264,41 @@ func (b *Bufferer) LoadIndex() error {
 // It will load any existing saved Buffer if found.
 func (b *Bufferer) Init() error {
 
-	// create dir if needs to
-	if _, err := os.Stat(b.RootPath); os.IsNotExist(err) {
-		err := os.MkdirAll(b.RootPath, 0755)
-		if err != nil {
+	if err := validBufferType(b.Type); err != nil {
+		return err
+	}
+	if b.Type == BufferTypeMemory {
+		return b.initMemory()
+	}
+
+	var err error
+	if b.ReadOnly {
+		if _, err = os.Stat(b.RootPath); err != nil {
 			return err
 		}
+	} else if err = b.checkWritable(); err != nil {
+		return err
 	}
 
-	// test write access at start time
-	fp := filepath.Join(b.RootPath, "dummy.txt")
-	f, err := os.Create(fp)
-	f.Write([]byte{' '})
-	f.Close()
-	defer os.Remove(fp)
+	if b.lockFile == nil {
+		if err = b.lock(); err != nil {
+			return err
+		}
+	}
+
+	if err = validBufferPolicy(b.Policy); err != nil {
+		return err
+	}
+	if err = validBufferSync(b.Sync); err != nil {
+		return err
+	}
+	if b.Keyring == nil && b.KeySource != "" {
+		// never buffer in clear what should be encrypted
+		if b.Keyring, err = NewBufferKeyring(b.KeySource, b.PreviousKeySources); err != nil {
+			return fmt.Errorf("Unable to load encryption keys: %v", err)
+		}
+	}
+	b.checkDiskSpace()
 
 	// insert here all the magic to recover from stop
 	err = b.LoadIndex()
@@ -200,35 +310,121 @@ func (b *Bufferer) Init() error {
 
 }
 
+// checkWritable creates the directory if needed
+// and tests the write access at start time
+func (b *Bufferer) checkWritable() error {
+	if _, err := os.Stat(b.RootPath); os.IsNotExist(err) {
+		err := os.MkdirAll(b.RootPath, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	fp := filepath.Join(b.RootPath, "dummy.txt")
+	f, err := os.Create(fp)
+	if err != nil {
+		return err
+	}
+	f.Write([]byte{' '})
+	f.Close()
+	return os.Remove(fp)
+}
+
+// initMemory sets up a memory buffer,
+// bounded in size with the default limit
+func (b *Bufferer) initMemory() error {
+	if err := validBufferPolicy(b.Policy); err != nil {
+		return err
+	}
+	if b.Limits.MaxBytes <= 0 && b.Limits.MaxPoints <= 0 {
+		b.Limits.MaxBytes = DefaultMemoryBufferSize
+	}
+	return b.LoadIndex()
+}
+
+// Close closes the current segment and
+// persists the read position
+func (b *Bufferer) Close() error {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	defer b.unlock()
+	if b.log == nil {
+		return nil
+	}
+	return b.log.Close()
+}
+
 func (b *Bufferer) Write(bp client.BatchPoints) error {
 	b.Lock.Lock()
 	defer b.Lock.Unlock()
-	bf := NewBufferFileFromBP(bp)
-	f, err := os.Create(filepath.Join(b.RootPath, bf.Filename))
+	return b.write(bp, time.Now())
+}
+
+// write appends the batch to the log, buffered at time ts.
+// Must be called with the lock held.
+func (b *Bufferer) write(bp client.BatchPoints, ts time.Time) error {
+	if b.log == nil {
+		return fmt.Errorf("Bufferer %v not initialised", b.RootPath)
+	}
+	if b.ReadOnly {
+		return fmt.Errorf("Bufferer %v is read-only", b.RootPath)
+	}
+
+	body, err := compressBody(b.Codec, b.CompressionLevel, encodePoints(bp))
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	bb := NewBatchBufferFromBP(bp)
-	content, err := json.Marshal(bb)
-	if err != nil {
+	rec := &walRecord{
+		Database:        bp.Database(),
+		RetentionPolicy: bp.RetentionPolicy(),
+		Precision:       bp.Precision(),
+		NumMetrics:      len(bp.Points()),
+		Timestamp:       ts,
+		Codec:           b.Codec,
+		Body:            body,
+	}
+	if b.Keyring != nil {
+		rec.KeyID = b.Keyring.Current()
+		if rec.Body, err = b.Keyring.seal(rec.header(), body); err != nil {
+			return err
+		}
+	}
+	if size := recordSize(rec); size > walHeaderSize+walMaxRecordSize && rec.NumMetrics > 1 {
+		// the log can't read back records that big
+		return b.writeHalves(bp, ts)
+	}
+	if err := b.expire(time.Now()); err != nil {
 		return err
-		// TODO: test and handle marshalling errors and delete file
 	}
-	if b.Compression {
-		w := zlib.NewWriter(f)
-		_, err = w.Write(content)
-		w.Close()
-	} else {
-		_, err = f.Write(content)
+	fits, err := b.makeRoom(recordSize(rec), int64(rec.NumMetrics))
+	if err != nil || !fits {
+		return err
 	}
+
+	bf, err := b.log.Append(rec)
 	if err != nil {
-		// again handle here file delete
 		return err
 	}
 
 	b.Index = append(b.Index, bf)
+	b.account(bf, 1)
+	b.syncBudget()
+	return nil
+}
+
+// writeHalves writes the batch as two records.
+// Must be called with the lock held.
+func (b *Bufferer) writeHalves(bp client.BatchPoints, ts time.Time) error {
+	points := bp.Points()
+	for _, half := range [][]*client.Point{points[:len(points)/2], points[len(points)/2:]} {
+		nbp := newBatchFrom(bp)
+		for _, p := range half {
+			nbp.AddPoint(p)
+		}
+		if err := b.write(nbp, ts); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -236,92 +432,282 @@ func (b *Bufferer) Write(bp client.BatchPoints) error {
 // All the batches from the Input channel will be
 // flushed into BufferFiles and written to disk
 func (b *Bufferer) Flush() error {
+	b.flushLock.Lock()
+	defer b.flushLock.Unlock()
 
-	batches := make(map[string]client.BatchPoints)
-
+	var queued []client.BatchPoints
 EMPTYCHANNEL:
 	for {
 		select {
 		case bp := <-b.Input:
-			ind := fmt.Sprintf("%s%s%s", bp.Database(), bp.RetentionPolicy(), bp.Precision())
-			if _, ok := batches[ind]; ok {
-				for _, p := range bp.Points() {
-					batches[ind].AddPoint(p)
-				}
-			} else {
-				batches[ind] = bp
-			}
+			queued = append(queued, bp)
 		default:
 			break EMPTYCHANNEL
 		}
 	}
 
-	for _, batch := range batches {
-		if err := b.Write(batch); err != nil {
+	if b.bounded() || b.Shared != nil {
+		// each batch goes through the policy on its own, and
+		// is stored the same way by the buffers sharing it
+		// whenever they flush
+		for _, bp := range queued {
+			if err := b.writeQueued(bp); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	batches := make(map[string]client.BatchPoints)
+	var order []string
+	for _, bp := range queued {
+		ind := fmt.Sprintf("%s%s%s", bp.Database(), bp.RetentionPolicy(), bp.Precision())
+		if _, ok := batches[ind]; !ok {
+			// the incoming batches can be shared with
+			// other servers, never append to them
+			batches[ind] = newBatchFrom(bp)
+			order = append(order, ind)
+		}
+		for _, p := range bp.Points() {
+			batches[ind].AddPoint(p)
+		}
+	}
+
+	for _, ind := range order {
+		if err := b.Write(batches[ind]); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// Pop returns the first (oldest) element of the index
+// account adds (sign 1) or removes (sign -1)
+// a record from the unread bytes and points.
+// Must be called with the lock held.
+func (b *Bufferer) account(bf *BufferFile, sign int64) {
+	b.bytes += sign * (bf.Size + bf.Shared)
+	b.shared += sign * bf.Shared
+	b.points += sign * int64(bf.NumMetrics)
+}
+
+// release drops the first element of the index
+// and moves the read position after it.
+// Must be called with the lock held.
+func (b *Bufferer) release() error {
+	err := b.log.Release(b.Index[0])
+	b.account(b.Index[0], -1)
+	b.Index = b.Index[1:]
+	if len(b.Index) == 0 {
+		if derr := b.log.Drained(); derr != nil && err == nil {
+			err = derr
+		}
+	}
+	b.syncBudget()
+	return err
+}
+
+// Pop returns the first (oldest) element of the index.
+// Corrupt records are skipped.
 func (b *Bufferer) Pop() (client.BatchPoints, error) {
 
 	b.Lock.Lock()
 	defer b.Lock.Unlock()
-	if len(b.Index) == 0 {
-		return nil, nil
+	if err := b.expire(time.Now()); err != nil {
+		return nil, err
 	}
+	for len(b.Index) > 0 {
+		bp, err := b.read(b.Index[0])
+		if err == errCorruptRecord || err == errTruncatedRecord {
+			log.Printf("Skipping corrupt record in %v: %v", b.RootPath, b.Index[0].Filename)
+			b.corrupted++
+			if err = b.release(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		b.delivered(b.Index[0])
+		return bp, b.release()
+	}
+	return nil, nil
 
-	bb := BatchBuffer{}
-	fd, err := os.Open(filepath.Join(b.RootPath, b.Index[0].Filename))
+}
+
+// Peek returns the oldest batches without removing them,
+// merging consecutive batches of the same database, retention
+// policy and precision up to maxPoints points each.
+// At most maxBatches batches are returned, along with the
+// records to Commit once they have been written.
+// Corrupt records at the head of the index are skipped.
+func (b *Bufferer) Peek(maxPoints, maxBatches int) ([]*BufferFile, []client.BatchPoints, error) {
+	peeked, err := b.peek(maxPoints, maxBatches)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	var files []*BufferFile
+	var batches []client.BatchPoints
+	for _, pb := range peeked {
+		files = append(files, pb.files...)
+		batches = append(batches, pb.bp)
+	}
+	return files, batches, nil
+}
 
-	var bf []byte
-	if b.Compression {
-		r, err := zlib.NewReader(fd)
-		if err != nil {
-			return nil, err
+// peekedBatch is a batch returned by peek,
+// merged from the records in files
+type peekedBatch struct {
+	bp    client.BatchPoints
+	files []*BufferFile
+}
+
+// peek is Peek, keeping the records of each batch
+func (b *Bufferer) peek(maxPoints, maxBatches int) ([]*peekedBatch, error) {
+
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	if err := b.expire(time.Now()); err != nil {
+		return nil, err
+	}
+	var batches []*peekedBatch
+	var last *peekedBatch
+	for i := 0; i < len(b.Index); i++ {
+		bf := b.Index[i]
+		bp, err := b.read(bf)
+		if err == errCorruptRecord || err == errTruncatedRecord {
+			if i > 0 {
+				// replay up to the corrupt record first
+				break
+			}
+			log.Printf("Skipping corrupt record in %v: %v", b.RootPath, bf.Filename)
+			b.corrupted++
+			if err = b.release(); err != nil {
+				return nil, err
+			}
+			i--
+			continue
 		}
-		bf, err = ioutil.ReadAll(r)
 		if err != nil {
 			return nil, err
 		}
-		r.Close()
-	} else {
-		bf, err = ioutil.ReadAll(fd)
-		if err != nil {
-			return nil, err
+		if last != nil && last.bp.Database() == bp.Database() &&
+			last.bp.RetentionPolicy() == bp.RetentionPolicy() &&
+			last.bp.Precision() == bp.Precision() &&
+			len(last.bp.Points())+len(bp.Points()) <= maxPoints {
+			last.bp.AddPoints(bp.Points())
+		} else {
+			if len(batches) == maxBatches {
+				break
+			}
+			last = &peekedBatch{bp: bp}
+			batches = append(batches, last)
 		}
+		last.files = append(last.files, bf)
 	}
+	return batches, nil
+}
 
-	fd.Close()
+// Commit removes the records returned by Peek.
+// Records evicted in the meantime are ignored.
+func (b *Bufferer) Commit(files []*BufferFile) error {
+	return b.commit(files, true)
+}
 
-	if err = json.Unmarshal(bf, &bb); err != nil {
-		return nil, err
+// discard removes the records returned by peek
+// that the backend refused
+func (b *Bufferer) discard(files []*BufferFile) error {
+	return b.commit(files, false)
+}
+
+func (b *Bufferer) commit(files []*BufferFile, delivered bool) error {
+
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	for _, bf := range files {
+		if len(b.Index) == 0 || b.Index[0] != bf {
+			continue
+		}
+		if delivered {
+			b.delivered(bf)
+		} else {
+			atomic.AddUint64(&b.Refused, uint64(bf.NumMetrics))
+		}
+		if err := b.release(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Len returns the number of buffered batches
+func (b *Bufferer) Len() int {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	return len(b.Index)
+}
+
+// Lag returns the age of the oldest buffered batch
+func (b *Bufferer) Lag() time.Duration {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	if len(b.Index) == 0 {
+		return 0
 	}
+	return time.Since(b.Index[0].Timestamp)
+}
 
-	bp, err := bb.BatchPoints()
+// read decodes the batch of an index entry
+func (b *Bufferer) read(bf *BufferFile) (client.BatchPoints, error) {
+	rec, err := b.log.Read(bf)
 	if err != nil {
 		return nil, err
 	}
-
-	err = os.Remove(filepath.Join(b.RootPath, b.Index[0].Filename))
-	b.Index = b.Index[1:]
-	return bp, err
-
+	body := rec.Body
+	if rec.KeyID != "" {
+		if b.Keyring == nil {
+			return nil, fmt.Errorf("no key %v to decrypt the record", rec.KeyID)
+		}
+		if body, err = b.Keyring.open(rec.KeyID, rec.authenticated(), body); err != nil {
+			return nil, err
+		}
+	}
+	// the codec of the record, whatever the current settings
+	body, err = decompressBody(rec.Codec, body)
+	if err != nil {
+		return nil, errCorruptRecord
+	}
+	return decodePoints(rec.Database, rec.RetentionPolicy, rec.Precision, body)
 }
 
 // Run is the main function
 func (b *Bufferer) Run() error {
 
 	t := time.NewTicker(b.FlushFrequency)
+	checkpoint := time.NewTicker(b.CheckpointFrequency)
+	defer t.Stop()
+	defer checkpoint.Stop()
 BUFFERERLOOP:
 	for {
 		select {
+		case <-checkpoint.C:
+			if err := b.SaveIndex(); err != nil {
+				log.Printf("Unable to checkpoint buffer %v: %v", b.RootPath, err)
+			}
+
+		case <-b.flush:
+			if err := b.Flush(); err != nil {
+				return err
+			}
+
 		case <-t.C:
+			b.checkDiskSpace()
+			b.Lock.Lock()
+			err := b.expire(time.Now())
+			b.Lock.Unlock()
+			if err != nil {
+				log.Printf("Unable to expire buffer %v: %v", b.RootPath, err)
+			}
 			if len(b.Input) > 0 {
 				if err := b.Flush(); err != nil {
 					return err
@@ -331,7 +717,7 @@ BUFFERERLOOP:
 		case <-b.Shutdown:
 			log.Println("Shutting down")
 			b.Flush()
-			b.SaveIndex()
+			b.Close()
 			break BUFFERERLOOP
 		}
 	}
@@ -342,7 +728,6 @@ BUFFERERLOOP:
 func (b *Bufferer) Stats() ([]models.Point, error) {
 
 	var pts []models.Point
-	// TODO: add individual db stats
 	b.Lock.Lock()
 	defer b.Lock.Unlock()
 	tags := models.NewTags(map[string]string{})
@@ -352,11 +737,31 @@ func (b *Bufferer) Stats() ([]models.Point, error) {
 		s += bf.NumMetrics
 	}
 	fields := map[string]interface{}{
-		"files":       len(b.Index),
+		"records":     len(b.Index),
 		"num_metrics": s,
 	}
-
-	pt, _ := models.NewPoint("sir_relaybuffer", tags, fields, time.Now())
+	if b.log != nil {
+		fields["files"] = b.log.Files()
+		fields["bytes"] = b.log.Size()
+		fields["corrupted"] = int64(b.log.Corrupt() + b.corrupted)
+	}
+	fields["evicted"] = int64(atomic.LoadUint64(&b.Evicted))
+	fields["dropped"] = int64(atomic.LoadUint64(&b.Dropped))
+	fields["rejected"] = int64(atomic.LoadUint64(&b.Rejected))
+	fields["expired"] = int64(atomic.LoadUint64(&b.Expired))
+	fields["refused"] = int64(atomic.LoadUint64(&b.Refused))
+	fields["low_disk"] = atomic.LoadUint32(&b.lowDisk) == 1
+	fields["queued"] = len(b.Input)
+	fields["spilled"] = int64(atomic.LoadUint64(&b.Spilled))
+	fields["blocked_ns"] = atomic.LoadInt64(&b.BlockedTime)
+	fields["max_blocked_ns"] = atomic.LoadInt64(&b.MaxBlockedTime)
+	fields["fsyncs"] = atomic.LoadInt64(&b.syncs.count)
+	fields["fsync_ns"] = atomic.LoadInt64(&b.syncs.total)
+	fields["max_fsync_ns"] = atomic.LoadInt64(&b.syncs.max)
+
+	now := time.Now()
+	pt, _ := models.NewPoint("sir_relaybuffer", tags, fields, now)
 	pts = append(pts, pt)
+	pts = append(pts, b.dbStats(now)...)
 	return pts, nil
 }
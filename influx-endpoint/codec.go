@@ -0,0 +1,169 @@
+package endpoint
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression codecs of the buffer records.
+// The codec is stored in each record so that
+// buffers written with other settings replay.
+const (
+	CodecNone   byte = 0
+	CodecGzip   byte = 1
+	CodecZlib   byte = 2
+	CodecSnappy byte = 3
+	CodecZstd   byte = 4
+	// codecDetect marks records written before the codec
+	// was stored, either raw or zlib compressed
+	codecDetect byte = 0xff
+)
+
+var codecNames = map[string]byte{
+	"none":   CodecNone,
+	"gzip":   CodecGzip,
+	"zlib":   CodecZlib,
+	"snappy": CodecSnappy,
+	"zstd":   CodecZstd,
+}
+
+// ParseCodec returns the codec of the given name
+func ParseCodec(name string) (byte, error) {
+	c, ok := codecNames[name]
+	if !ok {
+		return CodecNone, fmt.Errorf("Unknown compression codec %q", name)
+	}
+	return c, nil
+}
+
+// zstd encoders are costly to create, they
+// are shared per level as they are thread safe
+var (
+	zstdMutex    sync.Mutex
+	zstdEncoders = make(map[int]*zstd.Encoder)
+	zstdDecoder  *zstd.Decoder
+)
+
+func zstdEncoder(level int) (*zstd.Encoder, error) {
+	zstdMutex.Lock()
+	defer zstdMutex.Unlock()
+	if e, ok := zstdEncoders[level]; ok {
+		return e, nil
+	}
+	opts := []zstd.EOption{}
+	if level != 0 {
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	e, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	zstdEncoders[level] = e
+	return e, nil
+}
+
+func getZstdDecoder() (*zstd.Decoder, error) {
+	zstdMutex.Lock()
+	defer zstdMutex.Unlock()
+	if zstdDecoder == nil {
+		d, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		zstdDecoder = d
+	}
+	return zstdDecoder, nil
+}
+
+// compressBody compresses the body with the codec.
+// Level 0 selects the default level of the codec.
+func compressBody(codec byte, level int, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch codec {
+	case CodecNone:
+		return body, nil
+	case CodecSnappy:
+		return snappy.Encode(nil, body), nil
+	case CodecZstd:
+		e, err := zstdEncoder(level)
+		if err != nil {
+			return nil, err
+		}
+		return e.EncodeAll(body, nil), nil
+	case CodecGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		w, err = gzip.NewWriterLevel(&buf, level)
+	case CodecZlib:
+		if level == 0 {
+			level = zlib.DefaultCompression
+		}
+		w, err = zlib.NewWriterLevel(&buf, level)
+	default:
+		return nil, fmt.Errorf("Unknown compression codec %v", codec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(body); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// isZlib checks for a zlib header
+func isZlib(body []byte) bool {
+	return len(body) >= 2 && body[0]&0x0f == 8 && (uint16(body[0])<<8|uint16(body[1]))%31 == 0
+}
+
+// decompressBody reverses compressBody
+func decompressBody(codec byte, body []byte) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch codec {
+	case CodecNone:
+		return body, nil
+	case codecDetect:
+		if !isZlib(body) {
+			return body, nil
+		}
+		if raw, err := decompressBody(CodecZlib, body); err == nil {
+			return raw, nil
+		}
+		// line protocol that looked like zlib
+		return body, nil
+	case CodecSnappy:
+		return snappy.Decode(nil, body)
+	case CodecZstd:
+		d, err := getZstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		return d.DecodeAll(body, nil)
+	case CodecGzip:
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case CodecZlib:
+		r, err = zlib.NewReader(bytes.NewReader(body))
+	default:
+		return nil, fmt.Errorf("Unknown compression codec %v", codec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
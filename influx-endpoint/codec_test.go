@@ -0,0 +1,116 @@
+package endpoint_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+func TestBufferMixedCodecs(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	codecs := []string{"none", "gzip", "zlib", "snappy", "zstd"}
+	for _, name := range codecs {
+		codec, err := endpoint.ParseCodec(name)
+		if err != nil {
+			t.Fatalf("Could not parse codec %v: %v", name, err)
+		}
+		// restart with another codec each time
+		b := endpoint.NewBufferer()
+		b.RootPath = dir
+		b.Codec = codec
+		b.CompressionLevel = 1
+		if err := b.Init(); err != nil {
+			t.Fatalf("Could not init Bufferer: %v", err)
+		}
+		bp := createBatch()
+		bp.SetDatabase(name)
+		if err := b.Write(bp); err != nil {
+			t.Fatalf("Could not Write batch with %v: %v", name, err)
+		}
+		if err := b.Close(); err != nil {
+			t.Fatalf("Could not close: %v", err)
+		}
+	}
+
+	b := newTestBufferer(t, dir)
+	for _, name := range codecs {
+		bp, err := b.Pop()
+		if err != nil || bp == nil {
+			t.Fatalf("Could not pop the %v batch: %v", name, err)
+		}
+		if bp.Database() != name || len(bp.Points()) != 1 {
+			t.Errorf("Wrong batch for %v: %v", name, bp)
+		}
+	}
+
+	if _, err := endpoint.ParseCodec("lz4"); err == nil {
+		t.Errorf("Expected an error for an unknown codec")
+	}
+}
+
+// v1Record builds a record as written before codecs were stored
+func v1Record(db string, body []byte) []byte {
+	var payload bytes.Buffer
+	payload.WriteByte(1)
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(time.Now().UnixNano()))
+	payload.Write(n[:])
+	binary.BigEndian.PutUint32(n[:4], 1)
+	payload.Write(n[:4])
+	for _, s := range []string{db, "", "ns"} {
+		l := binary.PutUvarint(n[:], uint64(len(s)))
+		payload.Write(n[:l])
+		payload.WriteString(s)
+	}
+	payload.Write(body)
+
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(header[4:], crc32.Checksum(payload.Bytes(), crc32.MakeTable(crc32.Castagnoli)))
+	return append(header[:], payload.Bytes()...)
+}
+
+func TestBufferVersion1Records(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	line := []byte("cpu value=1 1000000000\n")
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	w.Write(line)
+	w.Close()
+
+	segment := append(v1Record("raw", line), v1Record("zlib", compressed.Bytes())...)
+	if err := ioutil.WriteFile(filepath.Join(dir, "0000000000000001.wal"), segment, 0644); err != nil {
+		t.Fatalf("Could not write segment: %v", err)
+	}
+
+	b := newTestBufferer(t, dir)
+	for _, db := range []string{"raw", "zlib"} {
+		bp, err := b.Pop()
+		if err != nil || bp == nil {
+			t.Fatalf("Could not pop the %v batch: %v", db, err)
+		}
+		if bp.Database() != db || len(bp.Points()) != 1 {
+			t.Errorf("Wrong batch for %v: %v", db, bp.Points())
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package endpoint
+
+import (
+	"net/http"
+)
+
+// BackendCredentials are the credentials
+// used to write to a backend
+type BackendCredentials struct {
+	Username string
+	Password string
+}
+
+// CredentialError is returned when a backend refuses
+// the credentials a write was posted with
+type CredentialError struct {
+	msg  string
+	code int
+}
+
+func (e *CredentialError) Error() string {
+	return e.msg
+}
+
+// StatusCode returns the HTTP status
+// matching the error for the listener
+func (e *CredentialError) StatusCode() int {
+	return e.code
+}
+
+// credentialError returns the CredentialError of a failed
+// write if the backend refused its credentials, nil otherwise
+func credentialError(err error) error {
+	werr, ok := err.(*WriteError)
+	if !ok {
+		return nil
+	}
+	switch werr.Code {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &CredentialError{msg: werr.msg, code: werr.Code}
+	}
+	return nil
+}
+
+// credentials returns the credentials to post a write with,
+// false to use those of the server: the mapping of the listener
+// user first, then the caller's own if they are forwarded.
+func (server *HTTPInfluxServer) credentials(opts *WriteOptions) (BackendCredentials, bool) {
+	if opts == nil {
+		return BackendCredentials{}, false
+	}
+	if opts.User != "" {
+		if creds, ok := server.UserMap[opts.User]; ok {
+			return creds, true
+		}
+	}
+	if server.ForwardCredentials && opts.Username != "" {
+		return BackendCredentials{Username: opts.Username, Password: opts.Password}, true
+	}
+	return BackendCredentials{}, false
+}
@@ -0,0 +1,130 @@
+package endpoint_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+func TestPostCredentials(t *testing.T) {
+
+	passwords := map[string]string{"relay": "relay", "alice": "secret", "metrics": "m3trics"}
+	var mutex sync.Mutex
+	var users []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, _ := r.BasicAuth()
+		if expected, ok := passwords[u]; !ok || expected != p {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"authorization failed"}`))
+			return
+		}
+		mutex.Lock()
+		users = append(users, u)
+		mutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	var config = `
+	[server.1]
+	alias = "test1"
+	username = "relay"
+	password = "relay"
+	forward_credentials = true
+
+	[server.1.user_map.bob]
+	username = "metrics"
+	password = "m3trics"
+	`
+	mgr, err := endpoint.NewHTTPInfluxServerMgrFromConfig(config)
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+	s := mgr.Endpoints["test1"]
+	s.Config.Addr = ts.URL
+	if err := s.Connect(); err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer s.Close()
+
+	for _, opts := range []*endpoint.WriteOptions{
+		nil,
+		{Username: "alice", Password: "secret"},
+		{User: "bob", Username: "bob", Password: "listener"},
+		{Username: "alice", Password: "secret"},
+	} {
+		if err := mgr.PostWithOptions(createBatch(), opts); err != nil {
+			t.Fatalf("Could not post with %+v: %v", opts, err)
+		}
+	}
+	expected := []string{"relay", "alice", "metrics", "alice"}
+	mutex.Lock()
+	if len(users) != len(expected) {
+		t.Fatalf("Expected writes as %v, got %v", expected, users)
+	}
+	for i := range expected {
+		if users[i] != expected[i] {
+			t.Errorf("Expected writes as %v, got %v", expected, users)
+			break
+		}
+	}
+	mutex.Unlock()
+
+	err = mgr.PostWithOptions(createBatch(), &endpoint.WriteOptions{Username: "alice", Password: "wrong"})
+	cerr, ok := err.(*endpoint.CredentialError)
+	if !ok || cerr.StatusCode() != http.StatusUnauthorized {
+		t.Fatalf("Expected a credential error, got %v", err)
+	}
+	// the backend refusing the caller is not a failure of the server
+	if err := s.Ping(); err != nil {
+		t.Errorf("Server should still be active: %v", err)
+	}
+}
+
+func TestCallerCredentialsNotBuffered(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	b := newTestBufferer(t, dir)
+	defer b.Close()
+	s, err := endpoint.NewHTTPInfluxServer("test1", nil, &client.HTTPConfig{Addr: ts.URL, Username: "relay", Password: "relay"})
+	if err != nil {
+		t.Fatalf("Could not create server: %v", err)
+	}
+	s.ForwardCredentials = true
+	s.Buffering = true
+	s.Bufferer = b
+	if err := s.Connect(); err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer s.Close()
+
+	// the buffer would replay it with the credentials of the server
+	if err := s.PostWithOptions(createBatch(), &endpoint.WriteOptions{Username: "alice", Password: "secret"}); err == nil {
+		t.Errorf("Write with the caller's credentials should fail")
+	}
+	if err := s.PostWithOptions(createBatch(), nil); err != nil {
+		t.Errorf("Write with the server's credentials should be buffered: %v", err)
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Could not flush: %v", err)
+	}
+	if b.Len() != 1 {
+		t.Errorf("Expected 1 buffered batch, got %v", b.Len())
+	}
+}
@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package endpoint
+
+import "errors"
+
+// diskFree is not supported on windows,
+// the free space threshold is ignored
+func diskFree(path string) (uint64, error) {
+	return 0, errors.New("free space monitoring not supported")
+}
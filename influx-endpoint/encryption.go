@@ -0,0 +1,152 @@
+package endpoint
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// BufferKeyring holds the keys encrypting the buffer records.
+// New records are sealed with the current key, the previous
+// keys are only used to open records written before a rotation.
+// Keys are identified by a hash so that records name their key.
+type BufferKeyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// readKey loads a key from a source of the form
+// file:<path> or env:<variable>. Keys of 16, 24 or 32
+// bytes are accepted, hex or base64 encoded.
+func readKey(source string) ([]byte, error) {
+	var raw string
+	switch {
+	case strings.HasPrefix(source, "file:"):
+		content, err := ioutil.ReadFile(strings.TrimPrefix(source, "file:"))
+		if err != nil {
+			return nil, err
+		}
+		raw = string(content)
+	case strings.HasPrefix(source, "env:"):
+		name := strings.TrimPrefix(source, "env:")
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("Environment variable %v not set", name)
+		}
+		raw = v
+	default:
+		return nil, fmt.Errorf("Invalid key source %q, expecting file:<path> or env:<variable>", source)
+	}
+	raw = strings.TrimSpace(raw)
+	key, err := hex.DecodeString(raw)
+	if err != nil {
+		if key, err = base64.StdEncoding.DecodeString(raw); err != nil {
+			return nil, fmt.Errorf("Key from %v is neither hex nor base64", source)
+		}
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("Key from %v must be 16, 24 or 32 bytes long, got %v", source, len(key))
+}
+
+// keyID identifies a key without revealing it
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// NewBufferKeyring loads the current and previous keys
+func NewBufferKeyring(current string, previous []string) (*BufferKeyring, error) {
+	k := &BufferKeyring{keys: make(map[string]cipher.AEAD)}
+	for i, source := range append([]string{current}, previous...) {
+		key, err := readKey(source)
+		if err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		id := keyID(key)
+		if i == 0 {
+			k.current = id
+		}
+		k.keys[id] = aead
+	}
+	return k, nil
+}
+
+// Current returns the id of the key sealing new records
+func (k *BufferKeyring) Current() string {
+	return k.current
+}
+
+// Has returns true if the keyring holds the key
+func (k *BufferKeyring) Has(id string) bool {
+	_, ok := k.keys[id]
+	return ok
+}
+
+// seal encrypts the body with the current key,
+// authenticating the unencrypted record header.
+// The nonce is prepended to the result.
+func (k *BufferKeyring) seal(header, body []byte) ([]byte, error) {
+	aead := k.keys[k.current]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(body)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, body, header), nil
+}
+
+// open reverses seal with the key of the record
+func (k *BufferKeyring) open(id string, header, sealed []byte) ([]byte, error) {
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("no key %v to decrypt the record", id)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errCorruptRecord
+	}
+	body, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], header)
+	if err != nil {
+		return nil, errCorruptRecord
+	}
+	return body, nil
+}
+
+// checkKeys makes sure every record of the index can be decrypted.
+// Must be called with the lock held.
+func (b *Bufferer) checkKeys() error {
+	missing := make(map[string]bool)
+	for _, bf := range b.Index {
+		if bf.KeyID == "" || missing[bf.KeyID] {
+			continue
+		}
+		if b.Keyring == nil || !b.Keyring.Has(bf.KeyID) {
+			missing[bf.KeyID] = true
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	var ids []string
+	for id := range missing {
+		ids = append(ids, id)
+	}
+	return fmt.Errorf("Buffer %v holds records encrypted with missing keys %v", b.RootPath, strings.Join(ids, ", "))
+}
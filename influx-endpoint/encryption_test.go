@@ -0,0 +1,163 @@
+package endpoint_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+func newKeyedBufferer(dir, key string, previous ...string) *endpoint.Bufferer {
+	b := endpoint.NewBufferer()
+	b.RootPath = dir
+	b.KeySource = key
+	b.PreviousKeySources = previous
+	return b
+}
+
+func TestBufferEncryption(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "old.key")
+	if err := ioutil.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)+"\n"), 0600); err != nil {
+		t.Fatalf("Could not write key: %v", err)
+	}
+	os.Setenv("SIR_TEST_BUFFER_KEY", strings.Repeat("cd", 16))
+	defer os.Unsetenv("SIR_TEST_BUFFER_KEY")
+	bufferDir := filepath.Join(dir, "buffer")
+
+	b := newKeyedBufferer(bufferDir, "file:"+keyFile)
+	if err := b.Init(); err != nil {
+		t.Fatalf("Could not init Bufferer: %v", err)
+	}
+	if err := b.Write(createBatch()); err != nil {
+		t.Fatalf("Could not Write batch: %v", err)
+	}
+	b.Close()
+	for _, s := range segments(t, bufferDir) {
+		content, _ := ioutil.ReadFile(s)
+		if bytes.Contains(content, []byte("cpu_usage")) {
+			t.Errorf("Points stored in clear in %v", s)
+		}
+	}
+
+	// the encrypted records can't be read without their key
+	b = newKeyedBufferer(bufferDir, "")
+	if err := b.Init(); err == nil || !strings.Contains(err.Error(), "missing keys") {
+		t.Errorf("Expected missing keys error, got %v", err)
+	}
+	b = newKeyedBufferer(bufferDir, "env:SIR_TEST_BUFFER_KEY")
+	if err := b.Init(); err == nil {
+		t.Errorf("Expected missing keys error after rotation without the previous key")
+	}
+
+	// rotation: the old key still reads the old records
+	b = newKeyedBufferer(bufferDir, "env:SIR_TEST_BUFFER_KEY", "file:"+keyFile)
+	if err := b.Init(); err != nil {
+		t.Fatalf("Could not init Bufferer: %v", err)
+	}
+	if err := b.Write(createBatch()); err != nil {
+		t.Fatalf("Could not Write batch: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		bp, err := b.Pop()
+		if err != nil || bp == nil || len(bp.Points()) != 1 {
+			t.Fatalf("Could not pop batch %v: %v", i, err)
+		}
+	}
+
+	// invalid keys are reported
+	b = newKeyedBufferer(bufferDir, "env:SIR_TEST_UNSET_KEY")
+	if err := b.Init(); err == nil {
+		t.Errorf("Expected an error for an unset key")
+	}
+}
+
+// v3Record builds a record encrypted with key
+// as written before the shared buffers
+func v3Record(t *testing.T, db string, key, body []byte) []byte {
+	sum := sha256.Sum256(key)
+	var header bytes.Buffer
+	header.Write([]byte{3, endpoint.CodecNone})
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(time.Now().UnixNano()))
+	header.Write(n[:])
+	binary.BigEndian.PutUint32(n[:4], 1)
+	header.Write(n[:4])
+	for _, s := range []string{db, "", "ns", hex.EncodeToString(sum[:4])} {
+		l := binary.PutUvarint(n[:], uint64(len(s)))
+		header.Write(n[:l])
+		header.WriteString(s)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("Could not create cipher: %v", err)
+	}
+	aead, _ := cipher.NewGCM(block)
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	payload := append(header.Bytes(), aead.Seal(nonce, nonce, body, header.Bytes())...)
+
+	var frame [8]byte
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.Checksum(payload, crc32.MakeTable(crc32.Castagnoli)))
+	return append(frame[:], payload...)
+}
+
+func TestBufferEncryptedVersion3Records(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := bytes.Repeat([]byte{0xab}, 32)
+	keyFile := filepath.Join(dir, "buffer.key")
+	if err := ioutil.WriteFile(keyFile, []byte(hex.EncodeToString(key)), 0600); err != nil {
+		t.Fatalf("Could not write key: %v", err)
+	}
+	bufferDir := filepath.Join(dir, "buffer")
+	os.MkdirAll(bufferDir, 0755)
+	segment := append(v3Record(t, "first", key, []byte("cpu value=1 1000000000\n")),
+		v3Record(t, "second", key, []byte("cpu value=2 1000000000\n"))...)
+	if err := ioutil.WriteFile(filepath.Join(bufferDir, "0000000000000001.wal"), segment, 0644); err != nil {
+		t.Fatalf("Could not write segment: %v", err)
+	}
+
+	b := newKeyedBufferer(bufferDir, "file:"+keyFile)
+	if err := b.Init(); err != nil {
+		t.Fatalf("Could not init Bufferer: %v", err)
+	}
+	// the first record is read as written,
+	// the second one after being moved by a purge
+	bp, err := b.Pop()
+	if err != nil || bp == nil || bp.Database() != "first" || len(bp.Points()) != 1 {
+		t.Fatalf("Could not pop the version 3 record: %v %v", bp, err)
+	}
+	if _, err := b.Purge(&endpoint.BufferFilter{Database: "other"}); err != nil {
+		t.Fatalf("Could not purge: %v", err)
+	}
+	bp, err = b.Pop()
+	if err != nil || bp == nil || bp.Database() != "second" || len(bp.Points()) != 1 {
+		t.Fatalf("Could not pop the version 3 record moved by purge: %v %v", bp, err)
+	}
+	b.Close()
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"path/filepath"
 	"sync"
 	"sync/atomic"
@@ -30,7 +31,9 @@ const (
 type HTTPInfluxServer struct {
 	Alias           string
 	Dbregex         []string
+	DbExclude       []string
 	Client          client.Client
+	httpClient      *http.Client
 	Status          uint32
 	Config          *client.HTTPConfig
 	Shutdown        chan struct{}
@@ -43,6 +46,24 @@ type HTTPInfluxServer struct {
 	Debug           bool
 	Buffering       bool
 	Bufferer        *Bufferer
+	Replayer        *Replayer
+	Rewrite         WriteRewrite
+	// StrictOrdering holds live writes in the buffer
+	// while a backlog is replayed
+	StrictOrdering bool
+	draining       uint32
+	// redirected is set while the backlog
+	// is replayed to another backend
+	redirected uint32
+	// replaying is held during the rounds
+	// replaying the backlog to the server
+	replaying sync.Mutex
+	ordering  sync.RWMutex
+	// ForwardCredentials posts the writes with the
+	// credentials of the caller, UserMap with those
+	// mapped to the listener user
+	ForwardCredentials bool
+	UserMap            map[string]BackendCredentials
 }
 
 // NewHTTPInfluxServer is a
@@ -75,6 +96,7 @@ func NewHTTPInfluxServer(alias string, dbregex []string, httpConfig *client.HTTP
 		DbCountersMutex: sync.Mutex{},
 		Buffering:       false,
 		Bufferer:        NewBufferer(),
+		Replayer:        NewReplayer(),
 	}, nil
 }
 
@@ -86,6 +108,7 @@ func (server *HTTPInfluxServer) Connect() error {
 		atomic.StoreUint32(&server.Status, ServerStateFailed)
 	} else {
 		server.Client = c
+		server.httpClient = newHTTPClient(server.Config)
 		atomic.StoreUint32(&server.Status, ServerStateActive)
 	}
 	return err
@@ -97,6 +120,11 @@ func (server *HTTPInfluxServer) Close() {
 	if server.Client != nil {
 		server.Client.Close()
 	}
+	if server.httpClient != nil {
+		if t, ok := server.httpClient.Transport.(*http.Transport); ok {
+			t.CloseIdleConnections()
+		}
+	}
 	atomic.StoreUint32(&server.Status, ServerStateInactive)
 }
 
@@ -112,25 +140,54 @@ func (d duration) toTimeDuration() time.Duration {
 // HTTPInfluxServerConfig is the struct to
 // map influx servers from config items
 type HTTPInfluxServerConfig struct {
-	ServerName        string `toml:"server_name"`
-	Alias             string
-	DBregex           []string `toml:"db_regex"`
-	Username          string
-	Password          string
-	Precision         string
-	WriteConsistency  string `toml:"write_consistency"`
-	Port              int
-	Timeout           duration
-	UnsafeSSL         bool `toml:"unsafe_ssl"`
-	Secure            bool
-	Disable           bool     `toml:"disable"`
-	ConcurrentRq      int      `toml:"max_concurrent_requests"`
-	PingFrequency     duration `toml:"ping_frequency"`
-	Debug             bool     `toml:"debug"`
-	Buffering         bool     `toml:"buffering"`
-	BufferPath        string   `toml:"buffer_path"`
-	BufferFlushFreq   duration `toml:"buffer_flush_frequency"`
-	BufferCompression bool     `toml:"buffer_compression"`
+	ServerName         string `toml:"server_name"`
+	Alias              string
+	DBregex            []string `toml:"db_regex"`
+	DBexclude          []string `toml:"db_exclude"`
+	Username           string
+	Password           string
+	Precision          string
+	WriteConsistency   string            `toml:"write_consistency"`
+	DatabaseRename     map[string]string `toml:"database_rename"`
+	RetentionPolicy    string            `toml:"retention_policy"`
+	RetentionPolicyMap map[string]string `toml:"retention_policy_map"`
+	Port               int
+	Timeout            duration
+	UnsafeSSL          bool `toml:"unsafe_ssl"`
+	Secure             bool
+	Disable            bool                          `toml:"disable"`
+	ConcurrentRq       int                           `toml:"max_concurrent_requests"`
+	PingFrequency      duration                      `toml:"ping_frequency"`
+	Debug              bool                          `toml:"debug"`
+	Buffering          bool                          `toml:"buffering"`
+	BufferPath         string                        `toml:"buffer_path"`
+	BufferType         string                        `toml:"buffer_type"`
+	BufferFlushFreq    duration                      `toml:"buffer_flush_frequency"`
+	BufferCompression  bool                          `toml:"buffer_compression"`
+	BufferCodec        string                        `toml:"buffer_codec"`
+	BufferLevel        int                           `toml:"buffer_compression_level"`
+	BufferKey          string                        `toml:"buffer_encryption_key"`
+	BufferPreviousKeys []string                      `toml:"buffer_encryption_previous_keys"`
+	BufferSync         string                        `toml:"buffer_sync"`
+	BufferSegmentSize  int64                         `toml:"buffer_segment_size"`
+	BufferCheckpoint   duration                      `toml:"buffer_checkpoint_frequency"`
+	BufferMaxBytes     int64                         `toml:"buffer_max_bytes"`
+	BufferMaxPoints    int64                         `toml:"buffer_max_points"`
+	BufferMaxFiles     int                           `toml:"buffer_max_files"`
+	BufferMaxAge       duration                      `toml:"buffer_max_age"`
+	BufferMinFree      uint64                        `toml:"buffer_min_free_bytes"`
+	BufferPolicy       string                        `toml:"buffer_policy"`
+	BufferQueueSize    int                           `toml:"buffer_queue_size"`
+	BufferHighWater    int                           `toml:"buffer_high_water_mark"`
+	BufferFlushSize    int                           `toml:"buffer_flush_size"`
+	ReplayRate         int64                         `toml:"replay_rate"`
+	ReplayMinRate      int64                         `toml:"replay_min_rate"`
+	ReplayConcurrency  int                           `toml:"replay_concurrency"`
+	ReplayBatchSize    int                           `toml:"replay_batch_size"`
+	ReplayAdaptive     bool                          `toml:"replay_adaptive"`
+	StrictOrdering     bool                          `toml:"strict_ordering"`
+	ForwardCredentials bool                          `toml:"forward_credentials"`
+	UserMap            map[string]BackendCredentials `toml:"user_map"`
 }
 
 func (d *duration) UnmarshalText(text []byte) error {
@@ -147,6 +204,15 @@ func NewHTTPInfluxServerParseConfig(config string) (*HTTPInfluxServerConfig, err
 	return &conf, err
 }
 
+// validate reports the settings a server can't run with
+func (c *HTTPInfluxServerConfig) validate() error {
+	if c.Buffering && c.BufferMaxFiles == 1 {
+		// one segment is always open for writing
+		return fmt.Errorf("Error: buffer_max_files of server %v must be at least 2", c.Alias)
+	}
+	return nil
+}
+
 // NewHTTPInfluxServerFromConfig creates a
 // server from a given config struct
 func NewHTTPInfluxServerFromConfig(c *HTTPInfluxServerConfig) *HTTPInfluxServer {
@@ -157,6 +223,7 @@ func NewHTTPInfluxServerFromConfig(c *HTTPInfluxServerConfig) *HTTPInfluxServer
 	} else {
 		new.Dbregex = c.DBregex
 	}
+	new.DbExclude = c.DBexclude
 	if c.Disable {
 		atomic.StoreUint32(&new.Status, ServerStateSuspended)
 	}
@@ -190,7 +257,28 @@ func NewHTTPInfluxServerFromConfig(c *HTTPInfluxServerConfig) *HTTPInfluxServer
 	new.DbCounters = make(map[string]uint64)
 	new.DbCountersMutex = sync.Mutex{}
 	new.Debug = c.Debug
+	new.Rewrite = WriteRewrite{
+		DatabaseRename:     c.DatabaseRename,
+		RetentionPolicy:    c.RetentionPolicy,
+		RetentionPolicyMap: c.RetentionPolicyMap,
+		WriteConsistency:   c.WriteConsistency,
+	}
+	if c.Precision != "" {
+		if err := validPrecision(c.Precision); err != nil {
+			log.Printf("Ignoring precision for server %v: %v", new.Alias, err)
+		} else {
+			new.Rewrite.Precision = c.Precision
+		}
+	}
+	new.ForwardCredentials = c.ForwardCredentials
+	new.UserMap = c.UserMap
 	new.Buffering = c.Buffering
+	new.StrictOrdering = c.StrictOrdering
+	if new.StrictOrdering {
+		// until the backlog found at start is replayed
+		new.draining = 1
+	}
+	new.Replayer = NewReplayer()
 	if new.Buffering {
 		new.Bufferer = NewBufferer()
 		if c.BufferPath != "" {
@@ -198,12 +286,84 @@ func NewHTTPInfluxServerFromConfig(c *HTTPInfluxServerConfig) *HTTPInfluxServer
 		} else {
 			new.Bufferer.RootPath = new.Alias
 		}
+		if c.BufferType != "" {
+			if err := validBufferType(c.BufferType); err != nil {
+				log.Printf("Ignoring buffer type for server %v: %v", new.Alias, err)
+			} else {
+				new.Bufferer.Type = c.BufferType
+			}
+		}
 		if c.BufferFlushFreq.Duration.String() != "0s" {
 			new.Bufferer.FlushFrequency = c.BufferFlushFreq.Duration
 		} else {
 			new.Bufferer.FlushFrequency, _ = time.ParseDuration("10s")
 		}
-		new.Bufferer.Compression = c.BufferCompression
+		if c.BufferCompression {
+			// kept from before the codecs
+			new.Bufferer.Codec = CodecZlib
+		}
+		if c.BufferCodec != "" {
+			if codec, err := ParseCodec(c.BufferCodec); err != nil {
+				log.Printf("Ignoring buffer codec for server %v: %v", new.Alias, err)
+			} else {
+				new.Bufferer.Codec = codec
+			}
+		}
+		new.Bufferer.CompressionLevel = c.BufferLevel
+		new.Bufferer.KeySource = c.BufferKey
+		new.Bufferer.PreviousKeySources = c.BufferPreviousKeys
+		if c.BufferSync != "" {
+			if err := validBufferSync(c.BufferSync); err != nil {
+				log.Printf("Ignoring buffer sync for server %v: %v", new.Alias, err)
+			} else {
+				new.Bufferer.Sync = c.BufferSync
+			}
+		}
+		if c.BufferSegmentSize > 0 {
+			new.Bufferer.SegmentSize = c.BufferSegmentSize
+		}
+		if c.BufferCheckpoint.Duration > 0 {
+			new.Bufferer.CheckpointFrequency = c.BufferCheckpoint.Duration
+		}
+		if c.BufferQueueSize > 0 {
+			new.Bufferer.SetQueueSize(c.BufferQueueSize)
+		}
+		if c.BufferHighWater > 0 {
+			new.Bufferer.HighWaterMark = c.BufferHighWater
+		}
+		if c.BufferFlushSize > 0 {
+			new.Bufferer.FlushSize = c.BufferFlushSize
+		}
+		new.Replayer.MaxRate = float64(c.ReplayRate)
+		new.Replayer.Adaptive = c.ReplayAdaptive
+		if c.ReplayMinRate > 0 {
+			new.Replayer.MinRate = float64(c.ReplayMinRate)
+		}
+		if c.ReplayConcurrency > 0 {
+			new.Replayer.Concurrency = c.ReplayConcurrency
+		}
+		if new.StrictOrdering && new.Replayer.Concurrency > 1 {
+			// concurrent rounds would reorder the backlog
+			log.Printf("Ignoring replay concurrency for server %v: strict ordering replays one batch at a time", new.Alias)
+			new.Replayer.Concurrency = 1
+		}
+		if c.ReplayBatchSize > 0 {
+			new.Replayer.BatchSize = c.ReplayBatchSize
+		}
+		new.Bufferer.Limits = BufferLimits{
+			MaxBytes:     c.BufferMaxBytes,
+			MaxPoints:    c.BufferMaxPoints,
+			MaxFiles:     c.BufferMaxFiles,
+			MaxAge:       c.BufferMaxAge.Duration,
+			MinFreeBytes: c.BufferMinFree,
+		}
+		if c.BufferPolicy != "" {
+			if err := validBufferPolicy(c.BufferPolicy); err != nil {
+				log.Printf("Ignoring buffer policy for server %v: %v", new.Alias, err)
+			} else {
+				new.Bufferer.Policy = c.BufferPolicy
+			}
+		}
 	}
 	return new
 }
@@ -240,6 +400,7 @@ func (server *HTTPInfluxServer) Stats() ([]models.Point, error) {
 		"active_req": len(server.concurrent),
 		"state":      int(atomic.LoadUint32(&server.Status)),
 		"posted":     int64(server.PostCounter),
+		"draining":   atomic.LoadUint32(&server.draining) == 1,
 	}
 
 	pt, _ := models.NewPoint("sir_backend", tags, fields, time.Now())
@@ -256,7 +417,8 @@ func (server *HTTPInfluxServer) Stats() ([]models.Point, error) {
 	}
 	if server.Buffering {
 		bpt, _ := server.Bufferer.Stats()
-		for _, p := range bpt {
+		rpt, _ := server.Replayer.Stats(server.Bufferer.Lag())
+		for _, p := range append(bpt, rpt...) {
 			p.AddTag("alias", server.Alias)
 			pts = append(pts, p)
 		}
@@ -264,16 +426,49 @@ func (server *HTTPInfluxServer) Stats() ([]models.Point, error) {
 	return pts, nil
 }
 
+// Pressure returns the saturation of the server, the
+// ratio of its requests in flight or of its buffer queue
+func (server *HTTPInfluxServer) Pressure() float64 {
+	var p float64
+	if c := cap(server.concurrent); c > 0 {
+		p = float64(len(server.concurrent)) / float64(c)
+	}
+	if server.Buffering {
+		if c := cap(server.Bufferer.Input); c > 0 {
+			if q := float64(len(server.Bufferer.Input)) / float64(c); q > p {
+				p = q
+			}
+		}
+	}
+	return p
+}
+
 // _port is the internal main posting function.
 // Returns nil if all good, otherwise error.
-func (server *HTTPInfluxServer) _post(bp client.BatchPoints) error {
+// The options give the credentials of the write, if any.
+func (server *HTTPInfluxServer) _post(bp client.BatchPoints, opts *WriteOptions) error {
+	creds, ok := server.credentials(opts)
+	if !ok {
+		creds = BackendCredentials{Username: server.Config.Username, Password: server.Config.Password}
+	}
 	server.concurrent <- struct{}{}
+	defer func() { <-server.concurrent }()
 	// TODO: manage conditional state
-	err := server.Client.Write(bp)
+	err := server.write(server.Rewrite.Apply(bp), creds.Username, creds.Password)
 	if err != nil {
 		if server.Debug {
 			log.Printf("Couldn't post to Influx server %v: %v", server.Alias, err)
 		}
+		if ok {
+			// the server is fine, the caller is not allowed
+			if cerr := credentialError(err); cerr != nil {
+				return cerr
+			}
+		}
+		if permanentError(err) {
+			// the server is fine, the batch is not
+			return err
+		}
 		server.Ping()
 		return err
 	}
@@ -286,7 +481,6 @@ func (server *HTTPInfluxServer) _post(bp client.BatchPoints) error {
 	}
 	server.DbCountersMutex.Unlock()
 
-	<-server.concurrent
 	// at the moment, pass the post err as is
 	return err
 }
@@ -294,49 +488,84 @@ func (server *HTTPInfluxServer) _post(bp client.BatchPoints) error {
 // Post is a wrapper around internal _post,
 // allowing smarter decision making.
 func (server *HTTPInfluxServer) Post(bp client.BatchPoints) error {
+	return server.PostWithOptions(bp, nil)
+}
+
+// PostWithOptions posts the batch points with the
+// credentials of the options. Buffered batches are
+// replayed with the credentials of the server.
+func (server *HTTPInfluxServer) PostWithOptions(bp client.BatchPoints, opts *WriteOptions) error {
 
+	if server.StrictOrdering && server.Buffering {
+		return server.postOrdered(bp, opts)
+	}
+	// the buffer doesn't keep the callers' credentials,
+	// their writes would be replayed with those of the server
+	_, caller := server.credentials(opts)
 	if atomic.LoadUint32(&server.Status) != ServerStateActive {
-		if server.Buffering {
-			server.Bufferer.Input <- bp
-			return nil
+		if server.Buffering && !caller {
+			return server.Bufferer.Add(bp)
 		}
 		return fmt.Errorf("Server %v is not active", server.Alias)
 	}
-	err := server._post(bp)
-	if err != nil && server.Buffering {
-		server.Bufferer.Input <- bp
-		return nil
+	err := server._post(bp, opts)
+	_, refused := err.(*CredentialError)
+	if err != nil && server.Buffering && !caller && !refused && !permanentError(err) {
+		return server.Bufferer.Add(bp)
 	}
 	return err
 
 }
 
-// ProcessBacklog will run and periodically process the backlog
-// of batches that are written to disk.
+// ProcessBacklog will run and process the backlog
+// of batches that are written to disk, at the pace
+// set by the Replayer of the server.
 func (server *HTTPInfluxServer) ProcessBacklog(stop chan struct{}) error {
-	// processing 40 per minute by default
-	backlog := time.NewTicker(15 * time.Millisecond)
-LOOP:
+	var wait time.Duration
 	for {
-		select {
-		case <-stop:
-			break LOOP
-		case <-backlog.C:
-			if server.Status == ServerStateActive {
-				bp, err := server.Bufferer.Pop()
-				if err != nil {
-					return err
-				}
-				if bp != nil {
-					if err = server.Post(bp); err != nil {
-						return err
-					}
-				}
+		if wait > 0 {
+			select {
+			case <-stop:
+				return nil
+			case <-time.After(wait):
+			}
+		} else {
+			select {
+			case <-stop:
+				return nil
+			default:
 			}
 		}
 
+		if atomic.LoadUint32(&server.Status) != ServerStateActive {
+			wait = replayIdle
+			continue
+		}
+		server.replaying.Lock()
+		if atomic.LoadUint32(&server.redirected) == 1 {
+			server.replaying.Unlock()
+			wait = replayIdle
+			continue
+		}
+		start := time.Now()
+		points, ok, err := server.replayRound()
+		server.replaying.Unlock()
+		if err != nil {
+			return err
+		}
+		if points == 0 {
+			if err = server.resumeDirect(); err != nil {
+				return err
+			}
+			wait = replayIdle
+			continue
+		}
+		if !ok {
+			wait = server.Replayer.backoff()
+			continue
+		}
+		wait = server.Replayer.delay(points, time.Since(start))
 	}
-	return nil
 }
 
 // Run is the main loop
@@ -5,12 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"regexp"
+	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
 )
 
 // Internal is the struct dedicated
@@ -21,15 +24,30 @@ type Internal struct {
 	Enable    bool
 }
 
+// StatsCollector is implemented by the components
+// reporting their statistics along with the backends
+type StatsCollector interface {
+	Stats() ([]models.Point, error)
+}
+
 // HTTPInfluxServerMgr is the struct
 // that manages multiple endpoints
 type HTTPInfluxServerMgr struct {
-	wg        sync.WaitGroup
-	Shutdown  chan struct{}
-	Telemetry Internal
-	Debug     bool
-	index     map[string][]*HTTPInfluxServer
-	Endpoints map[string]*HTTPInfluxServer
+	wg          sync.WaitGroup
+	Shutdown    chan struct{}
+	Telemetry   Internal
+	Debug       bool
+	table       atomic.Value
+	Endpoints   map[string]*HTTPInfluxServer
+	Rules       []*RoutingRule
+	TimeRouting *TimeRouting
+	// Shared holds the records bodies of the disk buffers, if set
+	Shared *SharedBuffer
+	// Collectors report statistics with the backends
+	Collectors []StatsCollector
+	// buffer replays by source alias
+	replays      map[string]*BufferReplay
+	replaysMutex sync.Mutex
 }
 
 // NewHTTPInfluxServerMgr is the constructur
@@ -37,7 +55,7 @@ type HTTPInfluxServerMgr struct {
 func NewHTTPInfluxServerMgr() *HTTPInfluxServerMgr {
 	m := HTTPInfluxServerMgr{}
 	m.Endpoints = make(map[string]*HTTPInfluxServer)
-	m.index = make(map[string][]*HTTPInfluxServer)
+	m.Rules = make([]*RoutingRule, 0)
 	m.Shutdown = make(chan struct{})
 	m.Telemetry = Internal{}
 	m.Telemetry.Database = "internal"
@@ -51,9 +69,12 @@ func NewHTTPInfluxServerMgr() *HTTPInfluxServerMgr {
 type internal Internal
 type server HTTPInfluxServerConfig
 type servers struct {
-	Server   map[string]server
-	Internal internal
-	Debug    bool
+	Server      map[string]server
+	Rule        []RoutingRuleConfig
+	TimeRouting TimeRoutingConfig  `toml:"time_routing"`
+	Buffering   BufferBudgetConfig `toml:"buffering"`
+	Internal    internal
+	Debug       bool
 }
 
 // NewHTTPInfluxServerMgrFromConfig is a constructor
@@ -72,6 +93,9 @@ func NewHTTPInfluxServerMgrFromConfig(config string) (*HTTPInfluxServerMgr, erro
 	for _, c := range e.Server {
 		// FIXME: horrible type cast
 		hc := HTTPInfluxServerConfig(c)
+		if err := hc.validate(); err != nil {
+			return m, err
+		}
 		s := NewHTTPInfluxServerFromConfig(&hc)
 		if m.Debug && !hc.Debug {
 			s.Debug = true
@@ -83,6 +107,46 @@ func NewHTTPInfluxServerMgrFromConfig(config string) (*HTTPInfluxServerMgr, erro
 		m.Endpoints[s.Alias] = s
 	}
 
+	// global limits shared by all the buffers
+	budget := NewBufferBudgetFromConfig(&e.Buffering)
+	if budget != nil {
+		for _, s := range m.Endpoints {
+			if s.Buffering {
+				s.Bufferer.Budget = budget
+			}
+		}
+	}
+	if e.Buffering.SharedPath != "" {
+		m.Shared = NewSharedBuffer(e.Buffering.SharedPath)
+		m.Shared.Budget = budget
+		for _, s := range m.Endpoints {
+			if !s.Buffering {
+				continue
+			}
+			if err := m.Shared.Attach(s.Bufferer); err != nil {
+				log.Printf("Ignoring shared buffer for server %v: %v", s.Alias, err)
+			}
+		}
+	}
+
+	// rules are evaluated in the order of the config file
+	for i := range e.Rule {
+		r, err := NewRoutingRuleFromConfig(&e.Rule[i], m.Endpoints)
+		if err != nil {
+			return m, err
+		}
+		m.Rules = append(m.Rules, r)
+	}
+
+	if m.TimeRouting, err = NewTimeRoutingFromConfig(&e.TimeRouting, m.Endpoints); err != nil {
+		return m, err
+	}
+
+	// compile the routing once, reporting invalid patterns now
+	if err = m.UpdateRoutingTable(); err != nil {
+		return m, err
+	}
+
 	if e.Internal.Database != "" {
 		m.Telemetry.Database = e.Internal.Database
 	}
@@ -107,19 +171,36 @@ func (mgr *HTTPInfluxServerMgr) GetServerPerName(s string) (*HTTPInfluxServer, e
 	return nil, errors.New("Could not find server " + s)
 }
 
+// UpdateRoutingTable compiles the routing table from
+// the current Endpoints and Rules and swaps it atomically.
+// The running table is kept if compilation fails.
+func (mgr *HTTPInfluxServerMgr) UpdateRoutingTable() error {
+	t, err := NewRoutingTable(mgr.Endpoints, mgr.Rules, mgr.TimeRouting)
+	if err != nil {
+		return err
+	}
+	mgr.table.Store(t)
+	return nil
+}
+
+// RoutingTable returns the current routing table,
+// compiling it first if needed.
+func (mgr *HTTPInfluxServerMgr) RoutingTable() *RoutingTable {
+	if t, ok := mgr.table.Load().(*RoutingTable); ok {
+		return t
+	}
+	if err := mgr.UpdateRoutingTable(); err != nil {
+		log.Printf("Unable to compile routing table: %v", err)
+		t, _ := NewRoutingTable(map[string]*HTTPInfluxServer{}, nil, nil)
+		return t
+	}
+	return mgr.table.Load().(*RoutingTable)
+}
+
 // GetInfluxServerbyDB returns the list of Servers
 // which regex match the db string
 func (mgr *HTTPInfluxServerMgr) GetInfluxServerbyDB(db string) []*HTTPInfluxServer {
-	var ret []*HTTPInfluxServer
-	for _, server := range mgr.Endpoints {
-		for _, reg := range server.Dbregex {
-			if match, err := regexp.MatchString(reg, db); match && err == nil {
-				ret = append(ret, server)
-				break
-			}
-		}
-	}
-	return ret
+	return mgr.RoutingTable().Lookup(db)
 }
 
 // StartAllServers triggers a start for
@@ -157,6 +238,24 @@ func (mgr *HTTPInfluxServerMgr) Stats() (client.BatchPoints, error) {
 			batch.AddPoint(client.NewPointFrom(p))
 		}
 	}
+	if mgr.Shared != nil {
+		spt, _ := mgr.Shared.Stats()
+		for _, p := range spt {
+			batch.AddPoint(client.NewPointFrom(p))
+		}
+	}
+	if mgr.TimeRouting != nil {
+		tpt, _ := mgr.TimeRouting.Stats()
+		for _, p := range tpt {
+			batch.AddPoint(client.NewPointFrom(p))
+		}
+	}
+	for _, c := range mgr.Collectors {
+		cpt, _ := c.Stats()
+		for _, p := range cpt {
+			batch.AddPoint(client.NewPointFrom(p))
+		}
+	}
 	return batch, err
 }
 
@@ -183,6 +282,19 @@ func (mgr *HTTPInfluxServerMgr) Status() []byte {
 	return s
 }
 
+// Pressure returns the saturation of the most loaded
+// backend, from 0 (idle) to 1 (writers block): the ratio
+// of its requests in flight or of its buffer queue.
+func (mgr *HTTPInfluxServerMgr) Pressure() float64 {
+	var max float64
+	for _, s := range mgr.Endpoints {
+		if p := s.Pressure(); p > max {
+			max = p
+		}
+	}
+	return max
+}
+
 // StopAllServers triggers a stop on all
 // servers in Endpoints
 func (mgr *HTTPInfluxServerMgr) StopAllServers() {
@@ -190,28 +302,61 @@ func (mgr *HTTPInfluxServerMgr) StopAllServers() {
 		s.Shutdown <- struct{}{}
 	}
 	mgr.wg.Wait()
+	if mgr.Shared != nil {
+		mgr.Shared.Close()
+	}
 }
 
 // Post relays the batch points to the post function
-// of each endpoint
+// of each endpoint.
+// When routing rules or time routing are defined,
+// the batch is split per destination.
 func (mgr *HTTPInfluxServerMgr) Post(bp client.BatchPoints) error {
-	endpoints, ok := mgr.index[bp.Database()]
-	if !ok {
-		endpoints = mgr.GetInfluxServerbyDB(bp.Database())
-		mgr.index[bp.Database()] = endpoints
+	return mgr.post(bp, nil)
+}
+
+// post routes the batch points to the
+// servers, posting them with the options
+func (mgr *HTTPInfluxServerMgr) post(bp client.BatchPoints, opts *WriteOptions) error {
+	table := mgr.RoutingTable()
+	if len(table.Rules) > 0 || table.TimeRouting != nil {
+		batches, unroutable := table.Split(bp)
+		if len(batches) == 0 {
+			return &RoutingError{fmt.Sprintf("No endpoint for db %v", bp.Database()), http.StatusNotFound}
+		}
+		servers := make([]*HTTPInfluxServer, 0, len(batches))
+		for s := range batches {
+			servers = append(servers, s)
+		}
+		sort.Slice(servers, func(i, j int) bool { return servers[i].Alias < servers[j].Alias })
+		errs := &PostError{}
+		for _, s := range servers {
+			if err := s.PostWithOptions(batches[s], opts); err != nil {
+				errs.add(s.Alias, err)
+			}
+		}
+		if unroutable > 0 {
+			errs.add("", &RoutingError{fmt.Sprintf("partial write: no endpoint for %v points of db %v", unroutable, bp.Database()), http.StatusBadRequest})
+		}
+		return errs.err()
 	}
+	endpoints := table.Lookup(bp.Database())
 	if len(endpoints) == 0 {
-		return fmt.Errorf("No endpoint for db %v", bp.Database())
+		return &RoutingError{fmt.Sprintf("No endpoint for db %v", bp.Database()), http.StatusNotFound}
 	}
-	var err error
-	for _, s := range endpoints {
+	return postAll(endpoints, bp, opts)
+}
 
-		err = s.Post(bp)
-		if err != nil {
-			return err
+// postAll posts the batch to every server, carrying on
+// after a failure so one backend doesn't starve the others
+func postAll(servers []*HTTPInfluxServer, bp client.BatchPoints, opts *WriteOptions) error {
+	errs := &PostError{}
+	for _, s := range servers {
+		if err := s.PostWithOptions(bp, opts); err != nil {
+			errs.add(s.Alias, err)
 		}
 	}
-	return err
+	return errs.err()
 }
 
 // Run is the main loop
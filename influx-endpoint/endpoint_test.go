@@ -2,8 +2,12 @@ package endpoint_test
 
 import (
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -178,6 +182,37 @@ func TestEndpointWrite(t *testing.T) {
 	wg.Wait()
 }
 
+func TestEndpointWriteProxy(t *testing.T) {
+
+	var proxied uint32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host == "influx.invalid:8086" && r.URL.Path == "/write" {
+			atomic.AddUint32(&proxied, 1)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	c, err := endpoint.NewHTTPInfluxServer("test", nil, &client.HTTPConfig{
+		Addr:  "http://influx.invalid:8086",
+		Proxy: http.ProxyURL(proxyURL),
+	})
+	if err != nil {
+		t.Fatalf("Could not create server: %v", err)
+	}
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer c.Close()
+	if err := c.Post(createBatch()); err != nil {
+		t.Fatalf("Unable to post through the proxy: %v", err)
+	}
+	if atomic.LoadUint32(&proxied) != 1 {
+		t.Errorf("Expected the write to go through the proxy")
+	}
+}
+
 func TestEndpointWriteFailed(t *testing.T) {
 	var wg sync.WaitGroup
 	c, err := endpoint.NewHTTPInfluxServer(
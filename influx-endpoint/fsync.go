@@ -0,0 +1,87 @@
+package endpoint
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// Buffer sync modes, how the buffered data is flushed to
+// stable storage: never, on each checkpoint, or before
+// each write is acknowledged
+const (
+	BufferSyncNone     string = "none"
+	BufferSyncInterval string = "interval"
+	BufferSyncAlways   string = "always"
+)
+
+// validBufferSync checks the sync mode is known
+func validBufferSync(mode string) error {
+	switch mode {
+	case BufferSyncNone, BufferSyncInterval, BufferSyncAlways:
+		return nil
+	}
+	return fmt.Errorf("Unknown buffer sync %q", mode)
+}
+
+// syncStats tracks the latency of the fsync calls
+type syncStats struct {
+	count int64
+	total int64
+	max   int64
+}
+
+// done accounts for a fsync that started at start
+func (s *syncStats) done(start time.Time) {
+	d := int64(time.Since(start))
+	atomic.AddInt64(&s.count, 1)
+	atomic.AddInt64(&s.total, d)
+	for {
+		max := atomic.LoadInt64(&s.max)
+		if d <= max || atomic.CompareAndSwapInt64(&s.max, max, d) {
+			break
+		}
+	}
+}
+
+// file flushes a file to stable storage
+func (s *syncStats) file(f *os.File) error {
+	defer s.done(time.Now())
+	return f.Sync()
+}
+
+// dir flushes the entries of a directory, so that
+// the files created or renamed in it survive a crash
+func (s *syncStats) dir(dir string) error {
+	defer s.done(time.Now())
+	return syncDir(dir)
+}
+
+// writeFile writes a file atomically through a rename,
+// flushed to stable storage when syncs is set
+func writeFile(path string, data []byte, syncs *syncStats) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil && syncs != nil {
+		err = syncs.file(f)
+	}
+	if cerr := f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if syncs != nil {
+		return syncs.dir(filepath.Dir(path))
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package endpoint_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+// fsyncs returns the number of fsync calls made by the Bufferer
+func fsyncs(t *testing.T, b *endpoint.Bufferer) int64 {
+	pts, err := b.Stats()
+	if err != nil {
+		t.Fatalf("Could not get stats: %v", err)
+	}
+	fields, _ := pts[0].Fields()
+	return fields["fsyncs"].(int64)
+}
+
+func TestBufferSync(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := endpoint.NewBufferer()
+	b.RootPath = filepath.Join(dir, "unknown")
+	b.Sync = "sometimes"
+	if err := b.Init(); err == nil {
+		t.Errorf("Expected an unknown sync mode to fail")
+	}
+
+	for _, mode := range []string{endpoint.BufferSyncNone, endpoint.BufferSyncInterval, endpoint.BufferSyncAlways} {
+		b := endpoint.NewBufferer()
+		b.RootPath = filepath.Join(dir, mode)
+		b.Sync = mode
+		if err := b.Init(); err != nil {
+			t.Fatalf("Could not init Bufferer: %v", err)
+		}
+		if err := b.Write(createBatch()); err != nil {
+			t.Fatalf("Could not Write batch: %v", err)
+		}
+		written := fsyncs(t, b)
+		if err := b.SaveIndex(); err != nil {
+			t.Fatalf("Could not save index: %v", err)
+		}
+		checkpointed := fsyncs(t, b)
+
+		switch mode {
+		case endpoint.BufferSyncNone:
+			if checkpointed != 0 {
+				t.Errorf("Expected no fsync, got %v", checkpointed)
+			}
+		case endpoint.BufferSyncInterval:
+			// the new segment is synced, its records on checkpoint
+			if written != 1 || checkpointed != 2 {
+				t.Errorf("Expected 1 then 2 fsyncs, got %v and %v", written, checkpointed)
+			}
+		case endpoint.BufferSyncAlways:
+			if written != 2 || checkpointed != 2 {
+				t.Errorf("Expected 2 fsyncs, got %v and %v", written, checkpointed)
+			}
+		}
+		b.Close()
+	}
+}
+
+func TestBufferSyncAlwaysAdd(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := endpoint.NewBufferer()
+	b.RootPath = dir
+	b.Sync = endpoint.BufferSyncAlways
+	if err := b.Init(); err != nil {
+		t.Fatalf("Could not init Bufferer: %v", err)
+	}
+	defer b.Close()
+
+	// the batch is on disk and synced once Add returns
+	for i := 1; i <= 2; i++ {
+		if err := b.Add(createBatch()); err != nil {
+			t.Fatalf("Could not Add batch: %v", err)
+		}
+		if len(b.Input) != 0 || len(b.Index) != i {
+			t.Fatalf("Expected %v records and nothing queued, got %v and %v", i, len(b.Index), len(b.Input))
+		}
+	}
+	// the new segment, then each record
+	if n := fsyncs(t, b); n != 3 {
+		t.Errorf("Expected 3 fsyncs, got %v", n)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package endpoint
+
+import "os"
+
+// syncDir flushes the entries of a directory
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package endpoint
+
+// syncDir is not supported on windows,
+// directories can't be flushed
+func syncDir(dir string) error {
+	return nil
+}
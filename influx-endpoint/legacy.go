@@ -0,0 +1,107 @@
+package endpoint
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/segmentio/ksuid"
+)
+
+// legacyIndexFile is the index saved on clean shutdowns
+// by the one-file-per-batch buffers
+const legacyIndexFile = "index.json"
+
+// legacyFile is a batch file written by
+// the one-file-per-batch buffers
+type legacyFile struct {
+	id   ksuid.KSUID
+	path string
+}
+
+// listLegacyFiles returns the batch files found in dir,
+// ordered by their ksuid time
+func listLegacyFiles(dir string) ([]legacyFile, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ret []legacyFile
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		id, err := ksuid.Parse(f.Name())
+		if err != nil {
+			continue
+		}
+		ret = append(ret, legacyFile{id: id, path: filepath.Join(dir, f.Name())})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return bytes.Compare(ret[i].id.Bytes(), ret[j].id.Bytes()) < 0
+	})
+	return ret, nil
+}
+
+// readLegacyFile decodes a batch file,
+// compressed with zlib or not
+func readLegacyFile(path string) (*BatchBuffer, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var bb BatchBuffer
+	if err = json.Unmarshal(content, &bb); err == nil {
+		return &bb, nil
+	}
+	r, zerr := zlib.NewReader(bytes.NewReader(content))
+	if zerr != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if content, err = ioutil.ReadAll(r); err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(content, &bb)
+	return &bb, err
+}
+
+// recoverLegacyFiles moves the batch files left by the
+// one-file-per-batch buffers into the log, oldest first.
+// Those files were orphaned if the relay crashed as the
+// index only got saved on clean shutdowns.
+// Unreadable files are renamed with a .corrupt suffix.
+// Must be called with the lock held.
+func (b *Bufferer) recoverLegacyFiles() (int, error) {
+	files, err := listLegacyFiles(b.RootPath)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, f := range files {
+		bb, err := readLegacyFile(f.path)
+		if err != nil {
+			log.Printf("Unable to recover buffer file %v: %v", f.path, err)
+			os.Rename(f.path, f.path+".corrupt")
+			continue
+		}
+		bp, err := bb.BatchPoints()
+		if err != nil {
+			log.Printf("Unable to recover buffer file %v: %v", f.path, err)
+			os.Rename(f.path, f.path+".corrupt")
+			continue
+		}
+		if err = b.write(bp, f.id.Time()); err != nil {
+			return n, err
+		}
+		os.Remove(f.path)
+		n++
+	}
+	os.Remove(filepath.Join(b.RootPath, legacyIndexFile))
+	return n, nil
+}
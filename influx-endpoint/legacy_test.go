@@ -0,0 +1,103 @@
+package endpoint_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+func writeLegacyFile(t *testing.T, dir string, ts time.Time, db string, compress bool) string {
+	id, _ := ksuid.NewRandomWithTime(ts)
+	bp := createBatch()
+	bp.SetDatabase(db)
+	content, _ := json.Marshal(endpoint.NewBatchBufferFromBP(bp))
+	if compress {
+		var buf bytes.Buffer
+		w := zlib.NewWriter(&buf)
+		w.Write(content)
+		w.Close()
+		content = buf.Bytes()
+	}
+	path := filepath.Join(dir, id.String())
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("Could not write legacy file: %v", err)
+	}
+	return path
+}
+
+func TestBuffererRecoverLegacyFiles(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	writeLegacyFile(t, dir, now.Add(-time.Minute), "second", true)
+	writeLegacyFile(t, dir, now.Add(-time.Hour), "first", false)
+	garbage, _ := ksuid.NewRandomWithTime(now)
+	ioutil.WriteFile(filepath.Join(dir, garbage.String()), []byte("garbage"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "index.json"), []byte("{}"), 0644)
+
+	b := newTestBufferer(t, dir)
+	if len(b.Index) != 2 {
+		t.Fatalf("Expected 2 recovered batches, got %v", len(b.Index))
+	}
+	for _, db := range []string{"first", "second"} {
+		bp, err := b.Pop()
+		if err != nil || bp == nil || bp.Database() != db || len(bp.Points()) != 1 {
+			t.Fatalf("Wrong recovered batch, expected %v: %v %v", db, bp, err)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(dir, garbage.String()+".corrupt")); err != nil {
+		t.Errorf("Unreadable file not set aside: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "index.json")); !os.IsNotExist(err) {
+		t.Errorf("Legacy index not removed: %v", err)
+	}
+}
+
+func TestBuffererPeriodicCheckpoint(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := newTestBufferer(t, dir)
+	b.CheckpointFrequency = 50 * time.Millisecond
+	for i := 0; i < 3; i++ {
+		if err := b.Write(createBatch()); err != nil {
+			t.Fatalf("Could not Write batch: %v", err)
+		}
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		b.Run()
+		wg.Done()
+	}()
+	if _, err := b.Pop(); err != nil {
+		t.Fatalf("Could not pop: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// simulate a crash: the buffer is reloaded without closing
+	crashed := newTestBufferer(t, dir)
+	if len(crashed.Index) != 2 {
+		t.Errorf("Expected 2 records after the crash, got %v", len(crashed.Index))
+	}
+	b.Shutdown <- struct{}{}
+	wg.Wait()
+}
@@ -0,0 +1,285 @@
+package endpoint
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// Buffer policies applied when a limit is hit
+const (
+	BufferPolicyDropOldest string = "drop_oldest"
+	BufferPolicyDropNewest string = "drop_newest"
+	BufferPolicyReject     string = "reject"
+)
+
+// ErrBufferFull is returned when a batch
+// is rejected by a full buffer
+var ErrBufferFull = errors.New("buffer full")
+
+// BufferLimits bounds the content of a buffer.
+// Zero values mean no limit.
+type BufferLimits struct {
+	MaxBytes  int64
+	MaxPoints int64
+	// MaxFiles counts the segment being written
+	MaxFiles int
+	MaxAge   time.Duration
+	// MinFreeBytes stops buffering when the
+	// filesystem has less space available
+	MinFreeBytes uint64
+}
+
+// validBufferPolicy checks the policy is known
+func validBufferPolicy(policy string) error {
+	switch policy {
+	case BufferPolicyDropOldest, BufferPolicyDropNewest, BufferPolicyReject:
+		return nil
+	}
+	return fmt.Errorf("Unknown buffer policy %q", policy)
+}
+
+// BufferBudgetConfig is the struct to map the
+// global buffer settings from config items
+type BufferBudgetConfig struct {
+	MaxBytes  int64 `toml:"max_bytes"`
+	MaxPoints int64 `toml:"max_points"`
+	MaxFiles  int   `toml:"max_files"`
+	// SharedPath enables the shared buffer in this directory
+	SharedPath string `toml:"shared_path"`
+}
+
+// BufferBudget tracks the usage of all the
+// buffers sharing it against global limits
+type BufferBudget struct {
+	MaxBytes  int64
+	MaxPoints int64
+	MaxFiles  int64
+	bytes     int64
+	points    int64
+	files     int64
+}
+
+// NewBufferBudgetFromConfig creates the global budget.
+// Returns nil when no limit is set.
+func NewBufferBudgetFromConfig(c *BufferBudgetConfig) *BufferBudget {
+	if c.MaxBytes <= 0 && c.MaxPoints <= 0 && c.MaxFiles <= 0 {
+		return nil
+	}
+	return &BufferBudget{
+		MaxBytes:  c.MaxBytes,
+		MaxPoints: c.MaxPoints,
+		MaxFiles:  int64(c.MaxFiles),
+	}
+}
+
+// add updates the usage with the given deltas
+func (bb *BufferBudget) add(bytes, points, files int64) {
+	atomic.AddInt64(&bb.bytes, bytes)
+	atomic.AddInt64(&bb.points, points)
+	atomic.AddInt64(&bb.files, files)
+}
+
+// over returns true if the extra usage would exceed a limit
+func (bb *BufferBudget) over(bytes, points, files int64) bool {
+	if bb.MaxBytes > 0 && atomic.LoadInt64(&bb.bytes)+bytes > bb.MaxBytes {
+		return true
+	}
+	if bb.MaxPoints > 0 && atomic.LoadInt64(&bb.points)+points > bb.MaxPoints {
+		return true
+	}
+	if bb.MaxFiles > 0 && atomic.LoadInt64(&bb.files)+files > bb.MaxFiles {
+		return true
+	}
+	return false
+}
+
+// Usage returns the bytes, points and files in use
+func (bb *BufferBudget) Usage() (int64, int64, int64) {
+	return atomic.LoadInt64(&bb.bytes), atomic.LoadInt64(&bb.points), atomic.LoadInt64(&bb.files)
+}
+
+// syncBudget reports the usage changes to the global budget.
+// Must be called with the lock held.
+func (b *Bufferer) syncBudget() {
+	var files int64
+	if b.log != nil {
+		files = int64(b.log.Files())
+	}
+	// the shared bytes are reported once, by the SharedBuffer
+	bytes := b.bytes - b.shared
+	if b.Budget != nil {
+		b.Budget.add(bytes-b.reported.bytes, b.points-b.reported.points, files-b.reported.files)
+	}
+	b.reported.bytes, b.reported.points, b.reported.files = bytes, b.points, files
+}
+
+// overLimits returns true if a record of the given size would
+// exceed a local or global limit.
+// Must be called with the lock held.
+func (b *Bufferer) overLimits(size, points int64) bool {
+	var files int64
+	if b.log != nil && b.log.wouldRotate(size) {
+		files = 1
+	}
+	l := b.Limits
+	if l.MaxBytes > 0 && b.bytes+size > l.MaxBytes {
+		return true
+	}
+	if l.MaxPoints > 0 && b.points+points > l.MaxPoints {
+		return true
+	}
+	if l.MaxFiles > 0 && b.log != nil && int64(b.log.Files())+files > int64(l.MaxFiles) {
+		return true
+	}
+	return b.Budget != nil && b.Budget.over(size, points, files)
+}
+
+// evictOldest drops the oldest record.
+// Must be called with the lock held.
+func (b *Bufferer) evictOldest() error {
+	atomic.AddUint64(&b.Evicted, uint64(b.Index[0].NumMetrics))
+	return b.release()
+}
+
+// expire drops the records older than the max age.
+// Must be called with the lock held.
+func (b *Bufferer) expire(now time.Time) error {
+	if b.Limits.MaxAge <= 0 {
+		return nil
+	}
+	for len(b.Index) > 0 && now.Sub(b.Index[0].Timestamp) > b.Limits.MaxAge {
+		atomic.AddUint64(&b.Expired, uint64(b.Index[0].NumMetrics))
+		if err := b.release(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// makeRoom applies the policy until a record of the given
+// size fits. Returns false if the record must not be written.
+// Must be called with the lock held.
+func (b *Bufferer) makeRoom(size, points int64) (bool, error) {
+	for b.overLimits(size, points) {
+		switch b.Policy {
+		case BufferPolicyDropOldest:
+			if len(b.Index) == 0 {
+				// the record alone is over the limits
+				atomic.AddUint64(&b.Dropped, uint64(points))
+				return false, nil
+			}
+			if err := b.evictOldest(); err != nil {
+				return false, err
+			}
+		case BufferPolicyDropNewest:
+			atomic.AddUint64(&b.Dropped, uint64(points))
+			return false, nil
+		case BufferPolicyReject:
+			// Add acknowledged the batch, other
+			// batches took the room meanwhile
+			atomic.AddUint64(&b.Dropped, uint64(points))
+			return false, nil
+		default:
+			return false, validBufferPolicy(b.Policy)
+		}
+	}
+	return true, nil
+}
+
+// bounded returns true if the buffer has limits
+// its records must fit in
+func (b *Bufferer) bounded() bool {
+	l := b.Limits
+	return l.MaxBytes > 0 || l.MaxPoints > 0 || l.MaxFiles > 0 || b.Budget != nil
+}
+
+// queuedSize returns the room a batch takes in the buffer,
+// the size before compression errs on the safe side
+func queuedSize(bp client.BatchPoints) (int64, int64) {
+	return int64(walHeaderSize + len(encodePoints(bp))), int64(len(bp.Points()))
+}
+
+// unqueue gives back the room Add held for a batch
+// that left the queue.
+// Must be called with the lock held.
+func (b *Bufferer) unqueue(bp client.BatchPoints) {
+	if b.Policy != BufferPolicyReject {
+		return
+	}
+	size, points := queuedSize(bp)
+	b.queued.bytes -= size
+	b.queued.points -= points
+	// batches put on Input directly weren't accounted
+	if b.queued.bytes < 0 || b.queued.points < 0 {
+		b.queued.bytes, b.queued.points = 0, 0
+	}
+}
+
+// writeQueued buffers a batch taken off the queue
+func (b *Bufferer) writeQueued(bp client.BatchPoints) error {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	// the room is given back once the batch is on disk,
+	// so that Add never counts it twice or not at all
+	defer b.unqueue(bp)
+	return b.write(bp, time.Now())
+}
+
+// checkDiskSpace flags the buffer when the
+// filesystem runs below the free space threshold
+func (b *Bufferer) checkDiskSpace() {
+	if b.Limits.MinFreeBytes == 0 {
+		return
+	}
+	free, err := diskFree(b.RootPath)
+	if err != nil {
+		return
+	}
+	var low uint32
+	if free < b.Limits.MinFreeBytes {
+		low = 1
+	}
+	if old := atomic.SwapUint32(&b.lowDisk, low); old != low {
+		if low == 1 {
+			log.Printf("Free space below threshold on %v, buffering stopped", b.RootPath)
+		} else {
+			log.Printf("Free space back above threshold on %v, buffering resumed", b.RootPath)
+		}
+	}
+}
+
+// Add queues a batch to be buffered.
+// When the buffer can't take it, the batch is dropped,
+// or rejected with ErrBufferFull under the reject policy.
+func (b *Bufferer) Add(bp client.BatchPoints) error {
+	points := uint64(len(bp.Points()))
+	if atomic.LoadUint32(&b.lowDisk) == 1 {
+		if b.Policy == BufferPolicyReject {
+			atomic.AddUint64(&b.Rejected, points)
+			return ErrBufferFull
+		}
+		atomic.AddUint64(&b.Dropped, points)
+		return nil
+	}
+	if b.Policy == BufferPolicyReject {
+		// the batches still queued take their room as well
+		size, n := queuedSize(bp)
+		b.Lock.Lock()
+		full := b.overLimits(b.queued.bytes+size, b.queued.points+n)
+		if !full {
+			b.queued.bytes += size
+			b.queued.points += n
+		}
+		b.Lock.Unlock()
+		if full {
+			atomic.AddUint64(&b.Rejected, points)
+			return ErrBufferFull
+		}
+	}
+	return b.enqueue(bp)
+}
@@ -0,0 +1,268 @@
+package endpoint_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+func newLimitedBufferer(t *testing.T, dir string, l endpoint.BufferLimits, policy string) *endpoint.Bufferer {
+	b := endpoint.NewBufferer()
+	b.RootPath = dir
+	b.Limits = l
+	b.Policy = policy
+	if err := b.Init(); err != nil {
+		t.Fatalf("Could not init Bufferer: %v", err)
+	}
+	return b
+}
+
+func TestBufferMaxPointsDropOldest(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := newLimitedBufferer(t, dir, endpoint.BufferLimits{MaxPoints: 2}, endpoint.BufferPolicyDropOldest)
+	for _, db := range []string{"a", "b", "c"} {
+		bp := createBatch()
+		bp.SetDatabase(db)
+		if err := b.Write(bp); err != nil {
+			t.Fatalf("Could not Write batch: %v", err)
+		}
+	}
+	if len(b.Index) != 2 {
+		t.Fatalf("Expected 2 records, got %v", len(b.Index))
+	}
+	if b.Evicted != 1 {
+		t.Errorf("Expected 1 evicted point, got %v", b.Evicted)
+	}
+	bp, err := b.Pop()
+	if err != nil || bp.Database() != "b" {
+		t.Errorf("Expected the oldest batch to be evicted, got %v (%v)", bp, err)
+	}
+}
+
+func TestBufferMaxPointsDropNewest(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := newLimitedBufferer(t, dir, endpoint.BufferLimits{MaxPoints: 2}, endpoint.BufferPolicyDropNewest)
+	for _, db := range []string{"a", "b", "c"} {
+		bp := createBatch()
+		bp.SetDatabase(db)
+		if err := b.Write(bp); err != nil {
+			t.Fatalf("Could not Write batch: %v", err)
+		}
+	}
+	if len(b.Index) != 2 || b.Dropped != 1 {
+		t.Fatalf("Expected 2 records and 1 dropped point, got %v and %v", len(b.Index), b.Dropped)
+	}
+	bp, err := b.Pop()
+	if err != nil || bp.Database() != "a" {
+		t.Errorf("Expected the oldest batch to be kept, got %v (%v)", bp, err)
+	}
+}
+
+func TestBufferReject(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := newLimitedBufferer(t, dir, endpoint.BufferLimits{MaxPoints: 1}, endpoint.BufferPolicyReject)
+	if err := b.Add(createBatch()); err != nil {
+		t.Fatalf("Expected the first batch to be accepted, got %v", err)
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Could not flush: %v", err)
+	}
+	if err := b.Add(createBatch()); err != endpoint.ErrBufferFull {
+		t.Errorf("Expected ErrBufferFull, got %v", err)
+	}
+	if b.Rejected != 1 {
+		t.Errorf("Expected 1 rejected point, got %v", b.Rejected)
+	}
+}
+
+func TestBufferRejectBatchSize(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// an empty buffer can't take a batch bigger than its limits
+	b := newLimitedBufferer(t, dir, endpoint.BufferLimits{MaxPoints: 2}, endpoint.BufferPolicyReject)
+	bp := createBatch()
+	for i := 0; i < 2; i++ {
+		bp.AddPoints(createBatch().Points())
+	}
+	if err := b.Add(bp); err != endpoint.ErrBufferFull {
+		t.Errorf("Expected ErrBufferFull for 3 points, got %v", err)
+	}
+	if b.Rejected != 3 {
+		t.Errorf("Expected 3 rejected points, got %v", b.Rejected)
+	}
+}
+
+// pointsBatch returns a batch of n points
+func pointsBatch(n int) client.BatchPoints {
+	bp := createBatch()
+	for i := 1; i < n; i++ {
+		bp.AddPoints(createBatch().Points())
+	}
+	return bp
+}
+
+func TestBufferLimitsQueuedBatches(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// each queued batch evicts what it needs, the newest are kept
+	b := newLimitedBufferer(t, dir, endpoint.BufferLimits{MaxPoints: 8}, endpoint.BufferPolicyDropOldest)
+	if err := b.Write(pointsBatch(8)); err != nil {
+		t.Fatalf("Could not Write batch: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := b.Add(pointsBatch(4)); err != nil {
+			t.Fatalf("Could not Add batch: %v", err)
+		}
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Could not flush: %v", err)
+	}
+	if len(b.Index) != 2 || b.Evicted != 12 || b.Dropped != 0 {
+		t.Errorf("Expected 2 records, 12 evicted and 0 dropped, got %v, %v and %v", len(b.Index), b.Evicted, b.Dropped)
+	}
+
+	// the queued batches count against the limits, what
+	// has been accepted is never dropped
+	dir2, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir2)
+	b = newLimitedBufferer(t, dir2, endpoint.BufferLimits{MaxPoints: 8}, endpoint.BufferPolicyReject)
+	for i := 0; i < 3; i++ {
+		err := b.Add(pointsBatch(4))
+		if i < 2 && err != nil {
+			t.Fatalf("Expected batch %v to be accepted, got %v", i, err)
+		}
+		if i == 2 && err != endpoint.ErrBufferFull {
+			t.Errorf("Expected ErrBufferFull, got %v", err)
+		}
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Could not flush: %v", err)
+	}
+	if len(b.Index) != 2 || b.Dropped != 0 || b.Rejected != 4 {
+		t.Errorf("Expected 2 records, 0 dropped and 4 rejected, got %v, %v and %v", len(b.Index), b.Dropped, b.Rejected)
+	}
+
+	// the room is given back once flushed
+	bp, err := b.Pop()
+	if err != nil || bp == nil {
+		t.Fatalf("Could not pop: %v", err)
+	}
+	if err := b.Add(pointsBatch(4)); err != nil {
+		t.Errorf("Expected the room of the popped batch, got %v", err)
+	}
+}
+
+func TestBufferMaxFilesConfig(t *testing.T) {
+
+	var config = `
+	[server.1]
+	alias = "test1"
+	buffering = true
+	buffer_max_files = 1
+	`
+	if _, err := endpoint.NewHTTPInfluxServerMgrFromConfig(config); err == nil {
+		t.Errorf("Expected an error for a single buffer file")
+	}
+}
+
+func TestBufferMaxAge(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := newLimitedBufferer(t, dir, endpoint.BufferLimits{MaxAge: 50 * time.Millisecond}, endpoint.BufferPolicyDropOldest)
+	if err := b.Write(createBatch()); err != nil {
+		t.Fatalf("Could not Write batch: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	bp, err := b.Pop()
+	if err != nil || bp != nil {
+		t.Errorf("Expected the batch to expire, got %v (%v)", bp, err)
+	}
+	if b.Expired != 1 {
+		t.Errorf("Expected 1 expired point, got %v", b.Expired)
+	}
+}
+
+func TestBufferGlobalBudget(t *testing.T) {
+
+	dir1, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir1)
+	dir2, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir2)
+
+	budget := endpoint.NewBufferBudgetFromConfig(&endpoint.BufferBudgetConfig{MaxPoints: 2})
+	b1 := endpoint.NewBufferer()
+	b1.RootPath = dir1
+	b1.Budget = budget
+	b1.Policy = endpoint.BufferPolicyDropNewest
+	b2 := endpoint.NewBufferer()
+	b2.RootPath = dir2
+	b2.Budget = budget
+	b2.Policy = endpoint.BufferPolicyDropNewest
+	for _, b := range []*endpoint.Bufferer{b1, b2} {
+		if err := b.Init(); err != nil {
+			t.Fatalf("Could not init Bufferer: %v", err)
+		}
+	}
+
+	for _, b := range []*endpoint.Bufferer{b1, b1, b2} {
+		if err := b.Write(createBatch()); err != nil {
+			t.Fatalf("Could not Write batch: %v", err)
+		}
+	}
+	if len(b2.Index) != 0 || b2.Dropped != 1 {
+		t.Errorf("Expected the global budget to be enforced, got %v records", len(b2.Index))
+	}
+	if _, points, _ := budget.Usage(); points != 2 {
+		t.Errorf("Expected 2 points in use, got %v", points)
+	}
+	b1.Pop()
+	if _, points, _ := budget.Usage(); points != 1 {
+		t.Errorf("Expected 1 point in use after pop, got %v", points)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package endpoint
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on the file,
+// failing if another process holds it.
+// Locks are released when the file is closed.
+func lockFile(f *os.File) error {
+	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &syscall.Flock_t{
+		Type:   syscall.F_WRLCK,
+		Whence: 0,
+	})
+}
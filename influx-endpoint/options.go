@@ -0,0 +1,138 @@
+package endpoint
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// WriteOptions carries the settings of a single
+// write request coming from the listener
+type WriteOptions struct {
+	// Backends overrides the routing when set:
+	// the batch is only sent to those aliases.
+	Backends []string
+	// User is the listener user who authenticated the
+	// write, empty if the listener has no users.
+	// Username and Password are the credentials the
+	// caller presented, forwarded to the servers set so.
+	User     string
+	Username string
+	Password string
+}
+
+// RoutingError is returned when a write
+// cannot be routed the way it was requested
+type RoutingError struct {
+	msg string
+	// code defaults to 400
+	code int
+}
+
+func (e *RoutingError) Error() string {
+	return e.msg
+}
+
+// StatusCode returns the HTTP status
+// matching the error for the listener
+func (e *RoutingError) StatusCode() int {
+	if e.code == 0 {
+		return http.StatusBadRequest
+	}
+	return e.code
+}
+
+// PostError gathers the failures of a write
+// relayed to several servers
+type PostError struct {
+	// servers holds the alias of the server
+	// of each failure, empty for the routing
+	servers []string
+	errs    []error
+}
+
+// add records the failure of a server
+func (e *PostError) add(alias string, err error) {
+	e.servers = append(e.servers, alias)
+	e.errs = append(e.errs, err)
+}
+
+// err returns nil without failures and the
+// failure itself when there is only one
+func (e *PostError) err() error {
+	switch len(e.errs) {
+	case 0:
+		return nil
+	case 1:
+		return e.errs[0]
+	}
+	return e
+}
+
+func (e *PostError) Error() string {
+	msgs := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		if e.servers[i] == "" {
+			msgs[i] = err.Error()
+		} else {
+			msgs[i] = fmt.Sprintf("%v: %v", e.servers[i], err)
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// StatusCode returns the most severe status of the
+// failures, so the client retries when a server
+// may accept the write later
+func (e *PostError) StatusCode() int {
+	code := 0
+	for _, err := range e.errs {
+		c := http.StatusServiceUnavailable
+		if sc, ok := err.(interface {
+			StatusCode() int
+		}); ok {
+			c = sc.StatusCode()
+		}
+		if c > code {
+			code = c
+		}
+	}
+	return code
+}
+
+// resolveOverride returns the servers targeted by an override,
+// checking each of them accepts the database.
+func (mgr *HTTPInfluxServerMgr) resolveOverride(db string, aliases []string) ([]*HTTPInfluxServer, error) {
+	var ret []*HTTPInfluxServer
+	allowed := make(map[*HTTPInfluxServer]bool)
+	for _, s := range mgr.RoutingTable().Lookup(db) {
+		allowed[s] = true
+	}
+	for _, alias := range aliases {
+		s, ok := mgr.Endpoints[alias]
+		if !ok {
+			return nil, &RoutingError{msg: fmt.Sprintf("unknown backend %v", alias)}
+		}
+		if !allowed[s] {
+			return nil, &RoutingError{msg: fmt.Sprintf("backend %v does not accept database %v", alias, db)}
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+// PostWithOptions relays the batch points according to the
+// options. When backends are set, the routing is bypassed and
+// the batch goes to exactly those servers.
+func (mgr *HTTPInfluxServerMgr) PostWithOptions(bp client.BatchPoints, opts *WriteOptions) error {
+	if opts == nil || len(opts.Backends) == 0 {
+		return mgr.post(bp, opts)
+	}
+	servers, err := mgr.resolveOverride(bp.Database(), opts.Backends)
+	if err != nil {
+		return err
+	}
+	return postAll(servers, bp, opts)
+}
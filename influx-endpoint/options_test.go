@@ -0,0 +1,75 @@
+package endpoint_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+func TestPostWithOptionsOverride(t *testing.T) {
+
+	ts1 := newRecordingTestServer()
+	defer ts1.Close()
+	ts2 := newRecordingTestServer()
+	defer ts2.Close()
+
+	var config = `
+	[server.1]
+	alias = "test1"
+
+	[server.2]
+	alias = "test2"
+
+	[server.3]
+	alias = "test3"
+	db_regex = ["other"]
+	`
+	mgr, err := endpoint.NewHTTPInfluxServerMgrFromConfig(config)
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+	mgr.Endpoints["test1"].Config.Addr = ts1.URL
+	mgr.Endpoints["test2"].Config.Addr = ts2.URL
+	for _, s := range mgr.Endpoints {
+		if err := s.Connect(); err != nil {
+			t.Fatalf("Could not connect: %v", err)
+		}
+	}
+
+	err = mgr.PostWithOptions(createBatch(), &endpoint.WriteOptions{Backends: []string{"test2"}})
+	if err != nil {
+		t.Fatalf("Could not post: %v", err)
+	}
+	if ts1.Count() != 0 || ts2.Count() != 1 {
+		t.Errorf("Override not honoured: test1=%v test2=%v", ts1.Lines, ts2.Lines)
+	}
+
+	err = mgr.PostWithOptions(createBatch(), &endpoint.WriteOptions{Backends: []string{"test4"}})
+	if _, ok := err.(*endpoint.RoutingError); !ok {
+		t.Errorf("Expected a routing error for an unknown backend, got %v", err)
+	}
+	err = mgr.PostWithOptions(createBatch(), &endpoint.WriteOptions{Backends: []string{"test3"}})
+	if _, ok := err.(*endpoint.RoutingError); !ok {
+		t.Errorf("Expected a routing error for a non matching backend, got %v", err)
+	}
+	if ts1.Count() != 0 || ts2.Count() != 1 {
+		t.Errorf("Failed overrides should not write: test1=%v test2=%v", ts1.Lines, ts2.Lines)
+	}
+}
+
+func TestPostNoEndpoint(t *testing.T) {
+
+	mgr, err := endpoint.NewHTTPInfluxServerMgrFromConfig(`
+	[server.1]
+	alias = "test1"
+	db_regex = ["other"]
+	`)
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+	err = mgr.Post(createBatch())
+	if rerr, ok := err.(*endpoint.RoutingError); !ok || rerr.StatusCode() != http.StatusNotFound {
+		t.Errorf("Expected a not found routing error, got %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package endpoint
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// postOrdered is the Post of servers with strict ordering:
+// once a batch has been buffered, live writes go to the
+// buffer too until the backlog is fully drained, so that
+// batches reach the backend in the order they came in.
+func (server *HTTPInfluxServer) postOrdered(bp client.BatchPoints, opts *WriteOptions) error {
+	server.ordering.RLock()
+	defer server.ordering.RUnlock()
+
+	_, caller := server.credentials(opts)
+	if atomic.LoadUint32(&server.draining) == 0 && atomic.LoadUint32(&server.Status) == ServerStateActive {
+		err := server._post(bp, opts)
+		if err == nil {
+			return nil
+		}
+		if _, refused := err.(*CredentialError); refused || caller || permanentError(err) {
+			return err
+		}
+	} else if caller {
+		// posting it now would overtake the backlog
+		return fmt.Errorf("Server %v is replaying its backlog", server.Alias)
+	}
+	if atomic.SwapUint32(&server.draining, 1) == 0 && server.Debug {
+		log.Printf("Server %v buffering live writes until the backlog is drained", server.Alias)
+	}
+	return server.Bufferer.Add(bp)
+}
+
+// resumeDirect switches the server back to direct posting
+// if the backlog is empty. Live writes are held while the
+// queue is flushed so that none of them can be left behind.
+func (server *HTTPInfluxServer) resumeDirect() error {
+	if atomic.LoadUint32(&server.draining) == 0 {
+		return nil
+	}
+	server.ordering.Lock()
+	defer server.ordering.Unlock()
+	if err := server.Bufferer.Flush(); err != nil {
+		return err
+	}
+	if server.Bufferer.Len() > 0 {
+		return nil
+	}
+	atomic.StoreUint32(&server.draining, 0)
+	if server.Debug {
+		log.Printf("Backlog of server %v drained, resuming direct writes", server.Alias)
+	}
+	return nil
+}
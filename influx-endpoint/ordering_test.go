@@ -0,0 +1,147 @@
+package endpoint_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+func namedBatch(name string) client.BatchPoints {
+	bp, _ := client.NewBatchPoints(client.BatchPointsConfig{Database: "test"})
+	pt, _ := client.NewPoint(name, nil, map[string]interface{}{"value": 1.0}, time.Now())
+	bp.AddPoint(pt)
+	return bp
+}
+
+func TestStrictOrdering(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var healthy uint32
+	var mutex sync.Mutex
+	var received []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Influxdb-Version", "x.x")
+		if r.URL.Path == "/write" {
+			if atomic.LoadUint32(&healthy) == 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			b, _ := ioutil.ReadAll(r.Body)
+			mutex.Lock()
+			for _, l := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+				received = append(received, strings.Fields(l)[0])
+			}
+			mutex.Unlock()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	var config = `
+	[server.1]
+	alias = "test1"
+	buffering = true
+	strict_ordering = true
+	`
+	mgr, err := endpoint.NewHTTPInfluxServerMgrFromConfig(config)
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+	server := mgr.Endpoints["test1"]
+	server.Config.Addr = ts.URL
+	server.Bufferer.RootPath = dir
+	if err := server.Bufferer.Init(); err != nil {
+		t.Fatalf("Could not init Bufferer: %v", err)
+	}
+	if err := server.Connect(); err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+
+	// first writes fail and get buffered
+	for _, name := range []string{"a", "b"} {
+		if err := server.Post(namedBatch(name)); err != nil {
+			t.Fatalf("Could not post: %v", err)
+		}
+	}
+
+	// the backend is back, live writes still go to the buffer
+	atomic.StoreUint32(&healthy, 1)
+	server.Ping()
+	if err := server.Post(namedBatch("c")); err != nil {
+		t.Fatalf("Could not post: %v", err)
+	}
+	mutex.Lock()
+	if len(received) != 0 {
+		t.Errorf("Live write sent before the backlog: %v", received)
+	}
+	mutex.Unlock()
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- server.ProcessBacklog(stop) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mutex.Lock()
+		n := len(received)
+		mutex.Unlock()
+		if n == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// leave time to switch back to direct writes
+	time.Sleep(300 * time.Millisecond)
+	if err := server.Post(namedBatch("d")); err != nil {
+		t.Fatalf("Could not post: %v", err)
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if strings.Join(received, ",") != "a,b,c,d" {
+		t.Errorf("Expected a,b,c,d, got %v", received)
+	}
+}
+
+func TestStrictOrderingConcurrency(t *testing.T) {
+
+	var config = `
+	[server.1]
+	alias = "test1"
+	buffering = true
+	strict_ordering = true
+	replay_concurrency = 4
+
+	[server.2]
+	alias = "test2"
+	buffering = true
+	replay_concurrency = 4
+	`
+	mgr, err := endpoint.NewHTTPInfluxServerMgrFromConfig(config)
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+	if c := mgr.Endpoints["test1"].Replayer.Concurrency; c != 1 {
+		t.Errorf("Strict ordering should replay one batch at a time, got %v", c)
+	}
+	if c := mgr.Endpoints["test2"].Replayer.Concurrency; c != 4 {
+		t.Errorf("Expected a replay concurrency of 4, got %v", c)
+	}
+}
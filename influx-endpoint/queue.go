@@ -0,0 +1,99 @@
+package endpoint
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// defaults derived from the size of the Input queue
+const (
+	defaultHighWaterRatio = 0.8
+	defaultFlushSizeRatio = 0.1
+)
+
+// SetQueueSize resizes the Input queue and
+// resets the marks derived from its size.
+// Must be called before the Bufferer runs.
+func (b *Bufferer) SetQueueSize(size int) {
+	b.Input = make(chan client.BatchPoints, size)
+	b.HighWaterMark = int(float64(size) * defaultHighWaterRatio)
+	b.FlushSize = int(float64(size) * defaultFlushSizeRatio)
+}
+
+// enqueue hands the batch over to the Run loop.
+// Past the high-water mark, or when the queue is full, the
+// queue is spilled to disk by the caller so that it never blocks.
+// When every write is synced, the batch is acknowledged
+// once on disk and doesn't wait on the queue.
+func (b *Bufferer) enqueue(bp client.BatchPoints) error {
+	start := time.Now()
+	if b.Sync == BufferSyncAlways {
+		err := b.spill(bp)
+		b.blocked(start)
+		return err
+	}
+	if b.HighWaterMark > 0 && len(b.Input) >= b.HighWaterMark {
+		atomic.AddUint64(&b.Spilled, 1)
+		if err := b.Flush(); err != nil {
+			b.forget(bp)
+			b.blocked(start)
+			return err
+		}
+	}
+	select {
+	case b.Input <- bp:
+	default:
+		// the queue filled up since the check,
+		// the batch follows the queue to disk
+		atomic.AddUint64(&b.Spilled, 1)
+		err := b.spill(bp)
+		b.blocked(start)
+		return err
+	}
+	b.blocked(start)
+
+	// flush on size as well as on time
+	if b.FlushSize > 0 && len(b.Input) >= b.FlushSize {
+		select {
+		case b.flush <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// spill writes the queue then the batch to disk
+func (b *Bufferer) spill(bp client.BatchPoints) error {
+	if err := b.Flush(); err != nil {
+		b.forget(bp)
+		return err
+	}
+	return b.writeQueued(bp)
+}
+
+// forget gives back the room of a batch
+// that never made it to the queue
+func (b *Bufferer) forget(bp client.BatchPoints) {
+	b.Lock.Lock()
+	b.unqueue(bp)
+	b.Lock.Unlock()
+}
+
+// blocked accounts for the time a caller
+// has been held by the Bufferer
+func (b *Bufferer) blocked(start time.Time) {
+	d := time.Since(start)
+	atomic.AddInt64(&b.BlockedTime, int64(d))
+	for {
+		max := atomic.LoadInt64(&b.MaxBlockedTime)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&b.MaxBlockedTime, max, int64(d)) {
+			break
+		}
+	}
+	if d > time.Second {
+		log.Printf("Buffer %v held a write for %v", b.RootPath, d)
+	}
+}
@@ -0,0 +1,145 @@
+package endpoint_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+func TestBufferSpillPastHighWaterMark(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := endpoint.NewBufferer()
+	b.RootPath = dir
+	b.SetQueueSize(4)
+	b.HighWaterMark = 2
+	b.FlushSize = 0
+	if err := b.Init(); err != nil {
+		t.Fatalf("Could not init Bufferer: %v", err)
+	}
+
+	// the Run loop is not started: without spilling,
+	// the fifth batch would block forever
+	done := make(chan struct{})
+	go func() {
+		for _, db := range []string{"a", "b", "c", "d", "e"} {
+			bp := createBatch()
+			bp.SetDatabase(db)
+			if err := b.Add(bp); err != nil {
+				t.Errorf("Could not add batch: %v", err)
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Add blocked on a full queue")
+	}
+
+	if b.Spilled == 0 {
+		t.Errorf("Expected the queue to be spilled")
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Could not flush: %v", err)
+	}
+	for _, db := range []string{"a", "b", "c", "d", "e"} {
+		bp, err := b.Pop()
+		if err != nil || bp == nil || bp.Database() != db {
+			t.Fatalf("Expected batch %v, got %v (%v)", db, bp, err)
+		}
+	}
+}
+
+func TestBufferFlushOnSize(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := endpoint.NewBufferer()
+	b.RootPath = dir
+	b.FlushFrequency = time.Hour
+	b.FlushSize = 2
+	if err := b.Init(); err != nil {
+		t.Fatalf("Could not init Bufferer: %v", err)
+	}
+	go b.Run()
+	defer func() { b.Shutdown <- struct{}{} }()
+
+	for i := 0; i < 2; i++ {
+		if err := b.Add(createBatch()); err != nil {
+			t.Fatalf("Could not add batch: %v", err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		b.Lock.Lock()
+		n := len(b.Index)
+		b.Lock.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Queue was not flushed on size")
+}
+
+func TestBufferSpillFullQueue(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := endpoint.NewBufferer()
+	b.RootPath = dir
+	b.SetQueueSize(2)
+	// without a high-water mark, only a full queue spills
+	b.HighWaterMark = 0
+	b.FlushSize = 0
+	if err := b.Init(); err != nil {
+		t.Fatalf("Could not init Bufferer: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for _, db := range []string{"a", "b", "c", "d"} {
+			bp := createBatch()
+			bp.SetDatabase(db)
+			if err := b.Add(bp); err != nil {
+				t.Errorf("Could not add batch: %v", err)
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Add blocked on a full queue")
+	}
+
+	if b.Spilled == 0 {
+		t.Errorf("Expected the queue to be spilled")
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Could not flush: %v", err)
+	}
+	for _, db := range []string{"a", "b", "c", "d"} {
+		bp, err := b.Pop()
+		if err != nil || bp == nil || bp.Database() != db {
+			t.Fatalf("Expected batch %v, got %v (%v)", db, bp, err)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package endpoint
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// Replay states
+const (
+	ReplayStateRunning string = "running"
+	ReplayStateDone    string = "done"
+	ReplayStateFailed  string = "failed"
+	ReplayStateStopped string = "stopped"
+)
+
+// ReplayError is returned when a replay
+// cannot be started or stopped
+type ReplayError struct {
+	msg  string
+	code int
+}
+
+func (e *ReplayError) Error() string {
+	return e.msg
+}
+
+// StatusCode returns the HTTP status
+// matching the error for the listener
+func (e *ReplayError) StatusCode() int {
+	return e.code
+}
+
+// BufferReplay moves the backlog of a server to another
+// backend, typically to decommission the server.
+type BufferReplay struct {
+	Source   string    `json:"source"`
+	Target   string    `json:"target"`
+	Started  time.Time `json:"started"`
+	State    string    `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Replayed uint64    `json:"replayed"`
+	Failures uint64    `json:"failures"`
+	replayer *Replayer
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// redactURL returns the URL without its credentials
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	u.User = nil
+	return u.String()
+}
+
+// NewHTTPInfluxServerFromURL creates a server writing to
+// the Influx at the given URL, credentials included.
+func NewHTTPInfluxServerFromURL(raw string) (*HTTPInfluxServer, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		// the error quotes the URL, credentials included
+		return nil, fmt.Errorf("Invalid Influx URL: %v", err.(*url.Error).Err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid Influx URL %q", redactURL(raw))
+	}
+	config := &client.HTTPConfig{
+		Addr:    u.Scheme + "://" + u.Host,
+		Timeout: 30 * time.Second,
+	}
+	if u.User != nil {
+		config.Username = u.User.Username()
+		config.Password, _ = u.User.Password()
+	}
+	server, err := NewHTTPInfluxServer(u.Host, nil, config)
+	if err != nil {
+		return nil, err
+	}
+	return server, server.Connect()
+}
+
+// DrainBuffer writes the backlog of the Bufferer to the target,
+// paced by the Replayer, until the backlog is empty or stop is
+// closed. Records are removed once the target acknowledged them.
+func DrainBuffer(b *Bufferer, r *Replayer, target *HTTPInfluxServer, stop <-chan struct{}) error {
+	var wait time.Duration
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(wait):
+		}
+		start := time.Now()
+		points, ok, err := replayRound(b, r, target.replayPost)
+		if err != nil {
+			return err
+		}
+		if points == 0 {
+			return nil
+		}
+		if !ok {
+			wait = r.backoff()
+			continue
+		}
+		wait = r.delay(points, time.Since(start))
+	}
+}
+
+// copyReplayer returns a new Replayer with the same settings
+func copyReplayer(r *Replayer) *Replayer {
+	return &Replayer{
+		MaxRate:     r.MaxRate,
+		MinRate:     r.MinRate,
+		Concurrency: r.Concurrency,
+		BatchSize:   r.BatchSize,
+		Adaptive:    r.Adaptive,
+	}
+}
+
+// ReplayBuffer starts moving the backlog of the source server
+// to the target, an alias or the URL of an Influx.
+// The source stops replaying its backlog to itself meanwhile.
+func (mgr *HTTPInfluxServerMgr) ReplayBuffer(source, target string) error {
+	src, ok := mgr.Endpoints[source]
+	if !ok {
+		return &ReplayError{fmt.Sprintf("unknown backend %v", source), http.StatusNotFound}
+	}
+	if !src.Buffering {
+		return &ReplayError{fmt.Sprintf("backend %v has no buffer", source), http.StatusBadRequest}
+	}
+	if dst, ok := mgr.Endpoints[target]; ok {
+		if dst == src {
+			return &ReplayError{"source and target are the same backend", http.StatusBadRequest}
+		}
+		// a disabled backend is never connected
+		if dst.httpClient == nil || atomic.LoadUint32(&dst.Status) == ServerStateSuspended {
+			return &ReplayError{fmt.Sprintf("backend %v is not active", target), http.StatusConflict}
+		}
+	}
+
+	mgr.replaysMutex.Lock()
+	defer mgr.replaysMutex.Unlock()
+	if mgr.replays == nil {
+		mgr.replays = make(map[string]*BufferReplay)
+	}
+	if rp, ok := mgr.replays[source]; ok && rp.running() {
+		return &ReplayError{fmt.Sprintf("backlog of %v already replayed to %v", source, rp.Target), http.StatusConflict}
+	}
+	// a target given by URL is only used by the replay
+	dst, alias := mgr.Endpoints[target]
+	if !alias {
+		var err error
+		if dst, err = NewHTTPInfluxServerFromURL(target); err != nil {
+			return &ReplayError{fmt.Sprintf("invalid target %v: %v", redactURL(target), err), http.StatusBadRequest}
+		}
+	}
+	rp := &BufferReplay{
+		Source:   source,
+		Target:   redactURL(target),
+		Started:  time.Now(),
+		State:    ReplayStateRunning,
+		replayer: copyReplayer(src.Replayer),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	mgr.replays[source] = rp
+
+	atomic.StoreUint32(&src.redirected, 1)
+	go func() {
+		// waits for the round of the source in flight
+		src.replaying.Lock()
+		src.replaying.Unlock()
+		err := DrainBuffer(src.Bufferer, rp.replayer, dst, rp.stop)
+		atomic.StoreUint32(&src.redirected, 0)
+		if !alias {
+			dst.Close()
+		}
+		mgr.replaysMutex.Lock()
+		switch {
+		case err != nil:
+			rp.State, rp.Error = ReplayStateFailed, err.Error()
+		case rp.State == ReplayStateRunning:
+			rp.State = ReplayStateDone
+		}
+		mgr.replaysMutex.Unlock()
+		close(rp.done)
+	}()
+	return nil
+}
+
+// running must be called with the replays lock held
+func (rp *BufferReplay) running() bool {
+	return rp.State == ReplayStateRunning
+}
+
+// StopReplay stops the replay of the source backlog
+// and waits for the current round to complete
+func (mgr *HTTPInfluxServerMgr) StopReplay(source string) error {
+	mgr.replaysMutex.Lock()
+	rp, ok := mgr.replays[source]
+	if !ok || !rp.running() {
+		mgr.replaysMutex.Unlock()
+		return &ReplayError{fmt.Sprintf("no replay of %v running", source), http.StatusNotFound}
+	}
+	rp.State = ReplayStateStopped
+	close(rp.stop)
+	mgr.replaysMutex.Unlock()
+	<-rp.done
+	return nil
+}
+
+// Replays returns the state of the buffer replays as json
+func (mgr *HTTPInfluxServerMgr) Replays() []byte {
+	mgr.replaysMutex.Lock()
+	defer mgr.replaysMutex.Unlock()
+	state := make([]BufferReplay, 0, len(mgr.replays))
+	for _, rp := range mgr.replays {
+		s := *rp
+		s.Replayed = atomic.LoadUint64(&rp.replayer.Replayed)
+		s.Failures = atomic.LoadUint64(&rp.replayer.Failures)
+		state = append(state, s)
+	}
+	b, _ := json.Marshal(state)
+	return b
+}
@@ -0,0 +1,98 @@
+package endpoint_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+func TestReplayBufferToURL(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := newRecordingTestServer()
+	defer target.Close()
+
+	var config = `
+	[server.1]
+	alias = "old"
+	buffering = true
+
+	[server.2]
+	alias = "new"
+
+	[server.3]
+	alias = "off"
+	disable = true
+	`
+	mgr, err := endpoint.NewHTTPInfluxServerMgrFromConfig(config)
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+	old := mgr.Endpoints["old"]
+	old.Bufferer.RootPath = dir
+	if err := old.Bufferer.Init(); err != nil {
+		t.Fatalf("Could not init Bufferer: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := old.Bufferer.Write(createBatch()); err != nil {
+			t.Fatalf("Could not Write batch: %v", err)
+		}
+	}
+
+	if err := mgr.ReplayBuffer("unknown", target.URL); err == nil {
+		t.Errorf("Expected an error for an unknown source")
+	}
+	if err := mgr.ReplayBuffer("new", target.URL); err == nil {
+		t.Errorf("Expected an error for a source without buffer")
+	}
+	if err := mgr.ReplayBuffer("old", "old"); err == nil {
+		t.Errorf("Expected an error replaying to the source")
+	}
+	// neither is connected, the disabled one never will be
+	for _, alias := range []string{"new", "off"} {
+		if err := mgr.ReplayBuffer("old", alias); err == nil {
+			t.Errorf("Expected an error replaying to the inactive %v", alias)
+		}
+	}
+	if err := mgr.ReplayBuffer("old", "ftp://nowhere"); err == nil {
+		t.Errorf("Expected an error for an invalid URL")
+	}
+
+	withCredentials := strings.Replace(target.URL, "://", "://admin:secret@", 1)
+	if err := mgr.ReplayBuffer("old", withCredentials); err != nil {
+		t.Fatalf("Could not start the replay: %v", err)
+	}
+	var replays []endpoint.BufferReplay
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := json.Unmarshal(mgr.Replays(), &replays); err != nil {
+			t.Fatalf("Could not decode replays: %v", err)
+		}
+		if len(replays) == 1 && replays[0].State != endpoint.ReplayStateRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(replays) != 1 || replays[0].State != endpoint.ReplayStateDone || replays[0].Replayed != 3 {
+		t.Fatalf("Expected the replay to complete, got %+v", replays)
+	}
+	if replays[0].Target != target.URL {
+		t.Errorf("Expected the target without its credentials, got %v", replays[0].Target)
+	}
+	if target.Count() != 3 || old.Bufferer.Len() != 0 {
+		t.Errorf("Expected the backlog to be moved, got %v lines and %v left", target.Count(), old.Bufferer.Len())
+	}
+	if err := mgr.StopReplay("old"); err == nil {
+		t.Errorf("Expected an error stopping a completed replay")
+	}
+}
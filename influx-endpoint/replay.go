@@ -0,0 +1,243 @@
+package endpoint
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+)
+
+// replay defaults
+const (
+	DefaultReplayBatchSize = 5000
+	DefaultReplayMinRate   = 100
+	// DefaultReplayRate is the starting rate of
+	// adaptive replays without a max rate
+	DefaultReplayRate = 10000
+	replayIdle        = 100 * time.Millisecond
+	// replayMaxBackoff bounds the pause
+	// after consecutive failed rounds
+	replayMaxBackoff = 30 * time.Second
+	// replay writes slower than this many times the
+	// average latency trigger a back off
+	replaySlowFactor = 2
+)
+
+// Replayer paces the writes of the backlog
+// of a server once it is reachable again.
+// Rates are in points per second.
+type Replayer struct {
+	// Replayed counts the points written from the backlog
+	Replayed uint64
+	Failures uint64
+
+	// MaxRate is the replay rate limit, 0 means none
+	MaxRate float64
+	// MinRate is the floor of the adaptive rate
+	MinRate     float64
+	Concurrency int
+	// BatchSize is the max number of points of merged batches
+	BatchSize int
+	// Adaptive backs off when the writes get slower
+	// or fail, and speeds up while the backend is healthy
+	Adaptive bool
+
+	mutex sync.Mutex
+	// retries counts the consecutive failed rounds
+	retries    int
+	rate       float64
+	latency    time.Duration
+	throughput float64
+	last       time.Time
+	lastCount  uint64
+}
+
+// NewReplayer creates a Replayer with the default settings
+func NewReplayer() *Replayer {
+	return &Replayer{
+		MinRate:     DefaultReplayMinRate,
+		Concurrency: 1,
+		BatchSize:   DefaultReplayBatchSize,
+	}
+}
+
+// Rate returns the current rate limit, 0 means none
+func (r *Replayer) Rate() float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.currentRate()
+}
+
+func (r *Replayer) currentRate() float64 {
+	if r.rate > 0 {
+		return r.rate
+	}
+	if r.Adaptive && r.MaxRate <= 0 {
+		return DefaultReplayRate
+	}
+	return r.MaxRate
+}
+
+// success records a replay round and
+// adapts the rate to its latency.
+func (r *Replayer) success(points int, d time.Duration) {
+	atomic.AddUint64(&r.Replayed, uint64(points))
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.retries = 0
+	if !r.Adaptive {
+		return
+	}
+	rate := r.currentRate()
+	if r.latency > 0 && d > replaySlowFactor*r.latency {
+		rate /= 2
+	} else {
+		// additive increase
+		rate += rate/10 + r.MinRate
+	}
+	r.rate = r.bound(rate)
+	// moving average of the latency
+	if r.latency == 0 {
+		r.latency = d
+	} else {
+		r.latency = (7*r.latency + d) / 8
+	}
+}
+
+// failure halves the adaptive rate
+func (r *Replayer) failure() {
+	atomic.AddUint64(&r.Failures, 1)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.retries++
+	if !r.Adaptive {
+		return
+	}
+	r.rate = r.bound(r.currentRate() / 2)
+}
+
+// backoff returns the pause after a failed round,
+// doubled by each consecutive failure
+func (r *Replayer) backoff() time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	d := replayIdle
+	for i := 1; i < r.retries && d < replayMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > replayMaxBackoff {
+		d = replayMaxBackoff
+	}
+	return d
+}
+
+func (r *Replayer) bound(rate float64) float64 {
+	if r.MaxRate > 0 && rate > r.MaxRate {
+		rate = r.MaxRate
+	}
+	if rate < r.MinRate {
+		rate = r.MinRate
+	}
+	return rate
+}
+
+// delay returns the pause after a round of points
+// written in d to stay under the current rate
+func (r *Replayer) delay(points int, d time.Duration) time.Duration {
+	rate := r.Rate()
+	if rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(points)/rate*float64(time.Second)) - d
+}
+
+// Stats returns the replay statistics,
+// lag being the age of the oldest batch
+func (r *Replayer) Stats(lag time.Duration) ([]models.Point, error) {
+	now := time.Now()
+	replayed := atomic.LoadUint64(&r.Replayed)
+	r.mutex.Lock()
+	if !r.last.IsZero() {
+		if elapsed := now.Sub(r.last).Seconds(); elapsed > 0 {
+			r.throughput = float64(replayed-r.lastCount) / elapsed
+		}
+	}
+	r.last, r.lastCount = now, replayed
+	fields := map[string]interface{}{
+		"replayed":   int64(replayed),
+		"failures":   int64(atomic.LoadUint64(&r.Failures)),
+		"rate":       r.currentRate(),
+		"throughput": r.throughput,
+		"latency_ns": int64(r.latency),
+		"lag_ns":     int64(lag),
+	}
+	r.mutex.Unlock()
+
+	pt, err := models.NewPoint("sir_replay", models.NewTags(map[string]string{}), fields, now)
+	if err != nil {
+		return nil, err
+	}
+	return []models.Point{pt}, nil
+}
+
+// replayRound writes one round of the backlog, one request
+// per batch. The records of the batches written are removed
+// from the buffer up to the first failed batch, the next ones
+// are written again later. The batches the backend refuses
+// are dropped. Returns the number of points of the round and
+// whether they have all been acknowledged or dropped.
+func replayRound(b *Bufferer, r *Replayer, post func(client.BatchPoints) error) (int, bool, error) {
+	batches, err := b.peek(r.BatchSize, r.Concurrency)
+	if err != nil || len(batches) == 0 {
+		return 0, false, err
+	}
+
+	var points int
+	errs := make([]error, len(batches))
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i, pb := range batches {
+		points += len(pb.bp.Points())
+		wg.Add(1)
+		go func(i int, bp client.BatchPoints) {
+			defer wg.Done()
+			errs[i] = post(bp)
+		}(i, pb.bp)
+	}
+	wg.Wait()
+
+	var written int
+	for i, pb := range batches {
+		switch {
+		case errs[i] == nil:
+			written += len(pb.bp.Points())
+			err = b.Commit(pb.files)
+		case permanentError(errs[i]):
+			log.Printf("Dropping %v points of %v refused by the backend: %v", len(pb.bp.Points()), b.RootPath, errs[i])
+			err = b.discard(pb.files)
+		default:
+			atomic.AddUint64(&r.Replayed, uint64(written))
+			r.failure()
+			return points, false, nil
+		}
+		if err != nil {
+			return points, false, err
+		}
+	}
+	r.success(written, time.Since(start))
+	return points, true, nil
+}
+
+// replayRound replays the backlog of the server to itself
+func (server *HTTPInfluxServer) replayRound() (int, bool, error) {
+	return replayRound(server.Bufferer, server.Replayer, server.replayPost)
+}
+
+// replayPost posts a buffered batch with the credentials
+// of the server, the buffers don't keep the callers' ones
+func (server *HTTPInfluxServer) replayPost(bp client.BatchPoints) error {
+	return server._post(bp, nil)
+}
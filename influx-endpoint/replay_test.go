@@ -0,0 +1,270 @@
+package endpoint_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+func TestBufferPeekMergesBatches(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := newTestBufferer(t, dir)
+	for _, db := range []string{"a", "a", "a", "b"} {
+		bp := createBatch()
+		bp.SetDatabase(db)
+		if err := b.Write(bp); err != nil {
+			t.Fatalf("Could not Write batch: %v", err)
+		}
+	}
+
+	files, batches, err := b.Peek(2, 10)
+	if err != nil {
+		t.Fatalf("Could not peek: %v", err)
+	}
+	if len(files) != 4 || len(batches) != 3 {
+		t.Fatalf("Expected 4 records in 3 batches, got %v in %v", len(files), len(batches))
+	}
+	if len(batches[0].Points()) != 2 || batches[2].Database() != "b" {
+		t.Errorf("Wrong merge: %v", batches)
+	}
+	if len(b.Index) != 4 {
+		t.Errorf("Peek removed records")
+	}
+
+	// limited number of batches
+	files, batches, _ = b.Peek(2, 1)
+	if len(files) != 2 || len(batches) != 1 {
+		t.Errorf("Expected 2 records in 1 batch, got %v in %v", len(files), len(batches))
+	}
+	if err := b.Commit(files); err != nil {
+		t.Fatalf("Could not commit: %v", err)
+	}
+	if len(b.Index) != 2 {
+		t.Errorf("Expected 2 records left, got %v", len(b.Index))
+	}
+}
+
+func TestReplayRetriesAndThrottles(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var healthy, writes uint32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Influxdb-Version", "x.x")
+		if r.URL.Path == "/write" {
+			atomic.AddUint32(&writes, 1)
+			if atomic.LoadUint32(&healthy) == 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	var config = `
+	[server.1]
+	alias = "test1"
+	buffering = true
+	replay_adaptive = true
+	replay_rate = 1000
+	replay_min_rate = 10
+	replay_batch_size = 1
+	`
+	mgr, err := endpoint.NewHTTPInfluxServerMgrFromConfig(config)
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+	server := mgr.Endpoints["test1"]
+	server.Config.Addr = ts.URL
+	server.Bufferer.RootPath = dir
+	if err := server.Bufferer.Init(); err != nil {
+		t.Fatalf("Could not init Bufferer: %v", err)
+	}
+	if err := server.Connect(); err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := server.Bufferer.Write(createBatch()); err != nil {
+			t.Fatalf("Could not Write batch: %v", err)
+		}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- server.ProcessBacklog(stop) }()
+
+	// failing writes keep the backlog and slow the replay down
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&server.Replayer.Failures) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if server.Replayer.Rate() >= 1000 {
+		t.Errorf("Expected the rate to back off, got %v", server.Replayer.Rate())
+	}
+	if server.Bufferer.Lag() == 0 {
+		t.Errorf("Expected the backlog to be kept")
+	}
+
+	// the backlog drains once the backend recovers
+	atomic.StoreUint32(&healthy, 1)
+	server.Ping()
+	deadline = time.Now().Add(10 * time.Second)
+	for atomic.LoadUint64(&server.Replayer.Replayed) < 5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if n := atomic.LoadUint64(&server.Replayer.Replayed); n != 5 {
+		t.Errorf("Expected 5 points replayed, got %v", n)
+	}
+	if server.Bufferer.Lag() != 0 {
+		t.Errorf("Expected the backlog to be drained")
+	}
+}
+
+// statusTestServer answers the writes to each
+// database with its status, 204 by default,
+// and counts them
+type statusTestServer struct {
+	*httptest.Server
+	mutex  sync.Mutex
+	writes map[string]int
+}
+
+func newStatusTestServer(status map[string]int) *statusTestServer {
+	ss := &statusTestServer{writes: make(map[string]int)}
+	ss.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Influxdb-Version", "x.x")
+		if r.URL.Path != "/write" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		db := r.URL.Query().Get("db")
+		ss.mutex.Lock()
+		ss.writes[db]++
+		ss.mutex.Unlock()
+		if code, ok := status[db]; ok {
+			w.WriteHeader(code)
+			w.Write([]byte(`{"error":"refused"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return ss
+}
+
+func (ss *statusTestServer) Writes(db string) int {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return ss.writes[db]
+}
+
+// newDrainTest buffers a batch per database
+// and returns the target of their replay
+func newDrainTest(t *testing.T, dir string, ts *httptest.Server, dbs ...string) (*endpoint.Bufferer, *endpoint.HTTPInfluxServer) {
+	b := newTestBufferer(t, dir)
+	for _, db := range dbs {
+		bp := createBatch()
+		bp.SetDatabase(db)
+		if err := b.Write(bp); err != nil {
+			t.Fatalf("Could not Write batch: %v", err)
+		}
+	}
+	target, err := endpoint.NewHTTPInfluxServer("target", nil, &client.HTTPConfig{Addr: ts.URL})
+	if err != nil {
+		t.Fatalf("Could not create server: %v", err)
+	}
+	if err := target.Connect(); err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	return b, target
+}
+
+func TestReplayDropsRefusedBatches(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := newStatusTestServer(map[string]int{"bad": http.StatusBadRequest})
+	defer ts.Close()
+	b, target := newDrainTest(t, dir, ts.Server, "a", "bad", "b")
+	defer b.Close()
+
+	r := endpoint.NewReplayer()
+	r.BatchSize = 1
+	done := make(chan error)
+	go func() { done <- endpoint.DrainBuffer(b, r, target, make(chan struct{})) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Drain failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The refused batch blocks the backlog")
+	}
+	if b.Len() != 0 || r.Replayed != 2 || b.Refused != 1 {
+		t.Errorf("Expected 2 points replayed and 1 refused, got %v, %v with %v left", r.Replayed, b.Refused, b.Len())
+	}
+	if ts.Writes("bad") != 1 {
+		t.Errorf("Expected the refused batch to be written once, got %v", ts.Writes("bad"))
+	}
+}
+
+func TestReplayPartialRoundBacksOff(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := newStatusTestServer(map[string]int{"down": http.StatusInternalServerError})
+	defer ts.Close()
+	b, target := newDrainTest(t, dir, ts.Server, "a", "down", "b")
+	defer b.Close()
+
+	r := endpoint.NewReplayer()
+	r.BatchSize = 1
+	r.Concurrency = 3
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- endpoint.DrainBuffer(b, r, target, stop) }()
+	time.Sleep(time.Second)
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+
+	// the batch before the failed one is committed,
+	// the one after it is written again
+	if ts.Writes("a") != 1 || b.Len() != 2 {
+		t.Errorf("Expected the first batch written once and 2 left, got %v and %v", ts.Writes("a"), b.Len())
+	}
+	if n := ts.Writes("down"); n > 5 {
+		t.Errorf("Expected the replay to back off, got %v writes in a second", n)
+	}
+}
@@ -0,0 +1,78 @@
+package endpoint
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// WriteRewrite describes how a batch is
+// rewritten before being written to a server
+type WriteRewrite struct {
+	DatabaseRename     map[string]string
+	RetentionPolicy    string
+	RetentionPolicyMap map[string]string
+	Precision          string
+	WriteConsistency   string
+}
+
+// validPrecision checks the precision is
+// understood by the influx client
+func validPrecision(p string) error {
+	if _, err := time.ParseDuration("1" + p); err != nil {
+		return fmt.Errorf("Invalid precision %q", p)
+	}
+	return nil
+}
+
+// IsEmpty returns true if the rewrite would
+// leave every batch unchanged
+func (w *WriteRewrite) IsEmpty() bool {
+	return len(w.DatabaseRename) == 0 &&
+		w.RetentionPolicy == "" &&
+		len(w.RetentionPolicyMap) == 0 &&
+		w.Precision == "" &&
+		w.WriteConsistency == ""
+}
+
+// Apply returns a batch rewritten with the server settings.
+// The points are shared with the original batch, which
+// is left untouched.
+func (w *WriteRewrite) Apply(bp client.BatchPoints) client.BatchPoints {
+	if w.IsEmpty() {
+		return bp
+	}
+
+	db := bp.Database()
+	if rename, ok := w.DatabaseRename[db]; ok {
+		db = rename
+	}
+	rp := bp.RetentionPolicy()
+	if w.RetentionPolicy != "" {
+		rp = w.RetentionPolicy
+	} else if mapped, ok := w.RetentionPolicyMap[rp]; ok {
+		rp = mapped
+	}
+	wc := bp.WriteConsistency()
+	if w.WriteConsistency != "" {
+		wc = w.WriteConsistency
+	}
+
+	nbp, _ := client.NewBatchPoints(client.BatchPointsConfig{
+		Database:         db,
+		RetentionPolicy:  rp,
+		WriteConsistency: wc,
+	})
+	// the client truncates the timestamps to the
+	// batch precision when writing
+	if w.Precision != "" {
+		nbp.SetPrecision(w.Precision)
+	} else {
+		nbp.SetPrecision(bp.Precision())
+	}
+	for _, p := range bp.Points() {
+		nbp.AddPoint(p)
+	}
+	return nbp
+}
@@ -0,0 +1,73 @@
+package endpoint_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+func TestWriteRewrite(t *testing.T) {
+
+	ts := newRecordingTestServer()
+	defer ts.Close()
+
+	config := `
+	server_name = "localhost"
+	alias = "test"
+	precision = "s"
+	write_consistency = "quorum"
+	database_rename = { BumbleBeeTuna = "tuna_dc2" }
+	retention_policy_map = { autogen = "raw" }
+	`
+	hc, err := endpoint.NewHTTPInfluxServerParseConfig(config)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	s := endpoint.NewHTTPInfluxServerFromConfig(hc)
+	s.Config.Addr = ts.URL
+	if err = s.Connect(); err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+
+	bp := createBatch()
+	bp.SetRetentionPolicy("autogen")
+	if err = s.Post(bp); err != nil {
+		t.Fatalf("Could not post: %v", err)
+	}
+	if len(ts.Queries) != 1 {
+		t.Fatalf("Expected 1 write, got %v", len(ts.Queries))
+	}
+	q := ts.Queries[0]
+	if q.Get("db") != "tuna_dc2" || q.Get("rp") != "raw" ||
+		q.Get("precision") != "s" || q.Get("consistency") != "quorum" {
+		t.Errorf("Batch not rewritten: %v", q)
+	}
+	// timestamps are converted to seconds
+	fields := strings.Fields(ts.Lines[0])
+	if ts := fields[len(fields)-1]; len(ts) != 10 {
+		t.Errorf("Timestamp not converted to seconds: %v", ts)
+	}
+	// the original batch is untouched
+	if bp.Database() != "BumbleBeeTuna" || bp.Precision() != "ms" {
+		t.Errorf("Original batch was modified: %v %v", bp.Database(), bp.Precision())
+	}
+}
+
+func TestWriteRewriteForcedRP(t *testing.T) {
+
+	w := endpoint.WriteRewrite{
+		RetentionPolicy:    "forced",
+		RetentionPolicyMap: map[string]string{"autogen": "raw"},
+	}
+	bp := createBatch()
+	bp.SetRetentionPolicy("autogen")
+	if nbp := w.Apply(bp); nbp.RetentionPolicy() != "forced" || len(nbp.Points()) != 1 {
+		t.Errorf("Retention policy not forced: %v", nbp.RetentionPolicy())
+	}
+
+	empty := endpoint.WriteRewrite{}
+	if nbp := empty.Apply(bp); nbp != bp {
+		t.Errorf("Empty rewrite should return the same batch")
+	}
+}
@@ -0,0 +1,176 @@
+package endpoint
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// RoutingRuleConfig is the struct to
+// map routing rules from config items
+type RoutingRuleConfig struct {
+	Name            string
+	Database        string            `toml:"database"`
+	RetentionPolicy string            `toml:"retention_policy"`
+	Measurement     string            `toml:"measurement"`
+	Tags            map[string]string `toml:"tags"`
+	Fields          []string          `toml:"fields"`
+	Backends        []string          `toml:"backends"`
+}
+
+// RoutingRule sends the points matching all its
+// matchers to a given set of backends.
+// Empty matchers always match.
+type RoutingRule struct {
+	Name            string
+	Database        *regexp.Regexp
+	RetentionPolicy *regexp.Regexp
+	Measurement     *regexp.Regexp
+	Tags            map[string]*regexp.Regexp
+	Fields          []string
+	Servers         []*HTTPInfluxServer
+}
+
+// compileMatcher compiles an anchored matcher of the rule
+func compileMatcher(rule, name, pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	reg, err := CompilePattern(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %v matcher %q in rule %v: %v", name, pattern, rule, err)
+	}
+	return reg, nil
+}
+
+// NewRoutingRuleFromConfig creates a rule from a
+// given config struct, resolving the backend aliases
+// against the known endpoints.
+func NewRoutingRuleFromConfig(c *RoutingRuleConfig, endpoints map[string]*HTTPInfluxServer) (*RoutingRule, error) {
+	var err error
+	r := &RoutingRule{
+		Name:   c.Name,
+		Tags:   make(map[string]*regexp.Regexp),
+		Fields: c.Fields,
+	}
+	if len(c.Backends) == 0 {
+		return r, fmt.Errorf("Rule %v has no backends", c.Name)
+	}
+	if r.Servers, err = resolveServers("Rule "+c.Name, c.Backends, endpoints); err != nil {
+		return r, err
+	}
+	if r.Database, err = compileMatcher(c.Name, "database", c.Database); err != nil {
+		return r, err
+	}
+	if r.RetentionPolicy, err = compileMatcher(c.Name, "retention_policy", c.RetentionPolicy); err != nil {
+		return r, err
+	}
+	if r.Measurement, err = compileMatcher(c.Name, "measurement", c.Measurement); err != nil {
+		return r, err
+	}
+	for k, v := range c.Tags {
+		reg, err := compileMatcher(c.Name, "tag "+k, v)
+		if err != nil {
+			return r, err
+		}
+		// a nil regex only checks for the tag presence
+		r.Tags[k] = reg
+	}
+	return r, nil
+}
+
+// MatchBatch returns false if the batch-wide matchers
+// (database and retention policy) exclude the batch.
+func (r *RoutingRule) MatchBatch(db, rp string) bool {
+	if r.Database != nil && !r.Database.MatchString(db) {
+		return false
+	}
+	if r.RetentionPolicy != nil && !r.RetentionPolicy.MatchString(rp) {
+		return false
+	}
+	return true
+}
+
+// MatchPoint returns true if the point matches
+// the measurement, tags and fields matchers.
+func (r *RoutingRule) MatchPoint(p *client.Point) bool {
+	if r.Measurement != nil && !r.Measurement.MatchString(p.Name()) {
+		return false
+	}
+	if len(r.Tags) > 0 {
+		tags := p.Tags()
+		for k, reg := range r.Tags {
+			v, ok := tags[k]
+			if !ok || (reg != nil && !reg.MatchString(v)) {
+				return false
+			}
+		}
+	}
+	if len(r.Fields) > 0 {
+		fields, err := p.Fields()
+		if err != nil {
+			return false
+		}
+		for _, f := range r.Fields {
+			if _, ok := fields[f]; !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// newBatchFrom creates an empty batch sharing
+// the settings of the given batch.
+func newBatchFrom(bp client.BatchPoints) client.BatchPoints {
+	nbp, _ := client.NewBatchPoints(client.BatchPointsConfig{
+		Database:         bp.Database(),
+		RetentionPolicy:  bp.RetentionPolicy(),
+		WriteConsistency: bp.WriteConsistency(),
+	})
+	// precision has been validated on the original batch
+	nbp.SetPrecision(bp.Precision())
+	return nbp
+}
+
+// splitBatch applies the routing rules to each point of the batch,
+// falling back to the default servers for points that match no rule.
+// It returns one batch per destination server and the number
+// of points that have no destination at all.
+func splitBatch(bp client.BatchPoints, rules []*RoutingRule, fallback func(*client.Point) []*HTTPInfluxServer) (map[*HTTPInfluxServer]client.BatchPoints, int) {
+	var candidates []*RoutingRule
+	for _, r := range rules {
+		if r.MatchBatch(bp.Database(), bp.RetentionPolicy()) {
+			candidates = append(candidates, r)
+		}
+	}
+
+	batches := make(map[*HTTPInfluxServer]client.BatchPoints)
+	var unroutable int
+	for _, p := range bp.Points() {
+		var servers []*HTTPInfluxServer
+		matched := false
+		for _, r := range candidates {
+			if r.MatchPoint(p) {
+				servers = r.Servers
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			servers = fallback(p)
+		}
+		if len(servers) == 0 {
+			unroutable++
+			continue
+		}
+		for _, s := range servers {
+			if _, ok := batches[s]; !ok {
+				batches[s] = newBatchFrom(bp)
+			}
+			batches[s].AddPoint(p)
+		}
+	}
+	return batches, unroutable
+}
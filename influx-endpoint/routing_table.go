@@ -0,0 +1,154 @@
+package endpoint
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// maxRoutingCacheSize bounds the number of cached databases
+const maxRoutingCacheSize = 10000
+
+// CompilePattern compiles a pattern of the configuration.
+// Patterns are anchored: "telegraf" only matches
+// telegraf, use "telegraf.*" for prefixes.
+func CompilePattern(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// compileDBPatterns compiles a list of database patterns,
+// ignoring empty ones.
+func compileDBPatterns(alias string, patterns []string) ([]*regexp.Regexp, error) {
+	var regs []*regexp.Regexp
+	for _, p := range patterns {
+		if p == "" {
+			continue
+		}
+		reg, err := CompilePattern(p)
+		if err != nil {
+			return regs, fmt.Errorf("Invalid database pattern %q for server %v: %v", p, alias, err)
+		}
+		regs = append(regs, reg)
+	}
+	return regs, nil
+}
+
+// serverRoute holds the compiled database
+// patterns of a server
+type serverRoute struct {
+	server  *HTTPInfluxServer
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+func (r *serverRoute) match(db string) bool {
+	for _, reg := range r.exclude {
+		if reg.MatchString(db) {
+			return false
+		}
+	}
+	for _, reg := range r.include {
+		if reg.MatchString(db) {
+			return true
+		}
+	}
+	return false
+}
+
+// RoutingTable is an immutable snapshot of the routing
+// configuration, compiled once.
+// The database lookups are cached in a copy-on-write map
+// so that concurrent readers never lock.
+type RoutingTable struct {
+	routes      []*serverRoute
+	Rules       []*RoutingRule
+	TimeRouting *TimeRouting
+	// cache holds a map[string][]*HTTPInfluxServer
+	cache atomic.Value
+	// mutex serialises the writers of the cache
+	mutex sync.Mutex
+}
+
+// NewRoutingTable compiles the routing table for the given
+// servers, rules and time routing (which can be nil).
+// Invalid patterns are reported as errors.
+func NewRoutingTable(endpoints map[string]*HTTPInfluxServer, rules []*RoutingRule, tr *TimeRouting) (*RoutingTable, error) {
+	t := &RoutingTable{
+		routes:      make([]*serverRoute, 0, len(endpoints)),
+		Rules:       rules,
+		TimeRouting: tr,
+	}
+	t.cache.Store(make(map[string][]*HTTPInfluxServer))
+	for _, s := range endpoints {
+		include, err := compileDBPatterns(s.Alias, s.Dbregex)
+		if err != nil {
+			return t, err
+		}
+		if len(include) == 0 {
+			include, _ = compileDBPatterns(s.Alias, []string{".*"})
+		}
+		exclude, err := compileDBPatterns(s.Alias, s.DbExclude)
+		if err != nil {
+			return t, err
+		}
+		t.routes = append(t.routes, &serverRoute{
+			server:  s,
+			include: include,
+			exclude: exclude,
+		})
+	}
+	return t, nil
+}
+
+// lookup returns the servers matching the database, uncached
+func (t *RoutingTable) lookup(db string) []*HTTPInfluxServer {
+	var ret []*HTTPInfluxServer
+	for _, r := range t.routes {
+		if r.match(db) {
+			ret = append(ret, r.server)
+		}
+	}
+	return ret
+}
+
+// Lookup returns the servers matching the database.
+func (t *RoutingTable) Lookup(db string) []*HTTPInfluxServer {
+	if servers, ok := t.cache.Load().(map[string][]*HTTPInfluxServer)[db]; ok {
+		return servers
+	}
+	servers := t.lookup(db)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	old := t.cache.Load().(map[string][]*HTTPInfluxServer)
+	if len(old) >= maxRoutingCacheSize {
+		return servers
+	}
+	cache := make(map[string][]*HTTPInfluxServer, len(old)+1)
+	for k, v := range old {
+		cache[k] = v
+	}
+	cache[db] = servers
+	t.cache.Store(cache)
+	return servers
+}
+
+// Split returns one batch per destination server.
+// Points are routed by the rules first, then by the
+// time routing and the database patterns. It also returns
+// the number of points no server accepts.
+func (t *RoutingTable) Split(bp client.BatchPoints) (map[*HTTPInfluxServer]client.BatchPoints, int) {
+	endpoints := t.Lookup(bp.Database())
+	fallback := func(*client.Point) []*HTTPInfluxServer { return endpoints }
+	if t.TimeRouting != nil && t.TimeRouting.Match(bp.Database()) {
+		now := time.Now()
+		fallback = func(p *client.Point) []*HTTPInfluxServer {
+			return t.TimeRouting.route(p, now)
+		}
+	}
+	return splitBatch(bp, t.Rules, fallback)
+}
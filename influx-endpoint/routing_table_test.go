@@ -0,0 +1,98 @@
+package endpoint_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+func TestRoutingTableIncludeExclude(t *testing.T) {
+
+	var config = `
+	[server.1]
+	alias = "test1"
+	db_regex = ["telegraf"]
+
+	[server.2]
+	alias = "test2"
+	db_regex = ["tele.*"]
+	db_exclude = ["telegraf_debug"]
+	`
+	mgr, err := endpoint.NewHTTPInfluxServerMgrFromConfig(config)
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+
+	expected := map[string]int{
+		"telegraf":       2,
+		"telegraf_dc2":   1,
+		"telegraf_debug": 0,
+		"mytelegraf":     0,
+	}
+	for db, n := range expected {
+		if s := mgr.GetInfluxServerbyDB(db); len(s) != n {
+			t.Errorf("Expected %v servers for %v, got %v", n, db, len(s))
+		}
+	}
+}
+
+func TestRoutingTableInvalidPattern(t *testing.T) {
+
+	var config = `
+	[server.1]
+	alias = "test1"
+	db_regex = ["tele(graf"]
+	`
+	if _, err := endpoint.NewHTTPInfluxServerMgrFromConfig(config); err == nil {
+		t.Errorf("Should fail on invalid db_regex")
+	}
+
+	config = `
+	[server.1]
+	alias = "test1"
+	db_exclude = ["*"]
+	`
+	if _, err := endpoint.NewHTTPInfluxServerMgrFromConfig(config); err == nil {
+		t.Errorf("Should fail on invalid db_exclude")
+	}
+}
+
+func TestRoutingTableConcurrentLookups(t *testing.T) {
+
+	var config = `
+	[server.1]
+	alias = "test1"
+
+	[server.2]
+	alias = "test2"
+	db_regex = ["db_1.*"]
+	`
+	mgr, err := endpoint.NewHTTPInfluxServerMgrFromConfig(config)
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				mgr.GetInfluxServerbyDB(fmt.Sprintf("db_%v", j))
+				if i == 0 && j%10 == 0 {
+					mgr.UpdateRoutingTable()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if s := mgr.GetInfluxServerbyDB("db_12"); len(s) != 2 {
+		t.Errorf("Expected 2 servers for db_12, got %v", len(s))
+	}
+	if s := mgr.GetInfluxServerbyDB("db_22"); len(s) != 1 {
+		t.Errorf("Expected 1 server for db_22, got %v", len(s))
+	}
+}
@@ -0,0 +1,283 @@
+package endpoint_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+// recordingTestServer keeps the lines
+// received on the write endpoint
+type recordingTestServer struct {
+	*httptest.Server
+	mutex   sync.Mutex
+	Lines   []string
+	Queries []url.Values
+}
+
+func newRecordingTestServer() *recordingTestServer {
+	rs := &recordingTestServer{}
+	rs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/write" {
+			rs.mutex.Lock()
+			rs.Queries = append(rs.Queries, r.URL.Query())
+			for _, l := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+				if l != "" {
+					rs.Lines = append(rs.Lines, l)
+				}
+			}
+			rs.mutex.Unlock()
+		}
+		w.Header().Set("X-Influxdb-Version", "x.x")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return rs
+}
+
+func (rs *recordingTestServer) Count() int {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	return len(rs.Lines)
+}
+
+func routingBatch(db string) client.BatchPoints {
+	bp, _ := client.NewBatchPoints(client.BatchPointsConfig{Database: db})
+	for _, m := range []string{"k8s_pod", "k8s_node", "cpu"} {
+		pt, _ := client.NewPoint(m,
+			map[string]string{"host": "a"},
+			map[string]interface{}{"value": 1.0},
+			time.Now())
+		bp.AddPoint(pt)
+	}
+	return bp
+}
+
+func TestRoutingRulesSplitBatch(t *testing.T) {
+
+	k8s := newRecordingTestServer()
+	defer k8s.Close()
+	other := newRecordingTestServer()
+	defer other.Close()
+
+	var config = `
+	[server.1]
+	alias = "k8s"
+	db_regex = ["^$"]
+
+	[server.2]
+	alias = "other"
+
+	[[rule]]
+	name = "kubernetes"
+	database = "^telegraf$"
+	measurement = "k8s_.*"
+	backends = ["k8s"]
+	`
+	mgr, err := endpoint.NewHTTPInfluxServerMgrFromConfig(config)
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+	if len(mgr.Rules) != 1 {
+		t.Fatalf("Expected 1 rule, got %v", len(mgr.Rules))
+	}
+	mgr.Endpoints["k8s"].Config.Addr = k8s.URL
+	mgr.Endpoints["other"].Config.Addr = other.URL
+	for _, s := range mgr.Endpoints {
+		if err := s.Connect(); err != nil {
+			t.Fatalf("Could not connect: %v", err)
+		}
+	}
+
+	if err = mgr.Post(routingBatch("telegraf")); err != nil {
+		t.Fatalf("Could not post: %v", err)
+	}
+	if k8s.Count() != 2 || other.Count() != 1 {
+		t.Errorf("Wrong split: k8s=%v other=%v", k8s.Lines, other.Lines)
+	}
+
+	// the rule doesn't apply to other databases
+	if err = mgr.Post(routingBatch("metrics")); err != nil {
+		t.Fatalf("Could not post: %v", err)
+	}
+	if k8s.Count() != 2 || other.Count() != 4 {
+		t.Errorf("Wrong routing: k8s=%v other=%v", k8s.Lines, other.Lines)
+	}
+}
+
+func TestRoutingRulesUnroutable(t *testing.T) {
+
+	k8s := newRecordingTestServer()
+	defer k8s.Close()
+	other := newRecordingTestServer()
+	defer other.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Influxdb-Version", "x.x")
+		if r.URL.Path == "/write" {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"engine down"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer down.Close()
+
+	var config = `
+	[server.1]
+	alias = "k8s"
+	db_regex = ["k8s"]
+
+	[server.2]
+	alias = "other"
+	db_regex = ["metrics"]
+
+	[server.3]
+	alias = "down"
+	db_regex = ["k8s"]
+
+	[[rule]]
+	name = "kubernetes"
+	database = "nodb"
+	measurement = "k8s_.*"
+	backends = ["k8s"]
+
+	[[rule]]
+	name = "broken"
+	database = "metrics"
+	measurement = "k8s_.*"
+	backends = ["down"]
+	`
+	mgr, err := endpoint.NewHTTPInfluxServerMgrFromConfig(config)
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+	mgr.Endpoints["k8s"].Config.Addr = k8s.URL
+	mgr.Endpoints["other"].Config.Addr = other.URL
+	mgr.Endpoints["down"].Config.Addr = down.URL
+	for _, s := range mgr.Endpoints {
+		if err := s.Connect(); err != nil {
+			t.Fatalf("Could not connect: %v", err)
+		}
+	}
+
+	// the cpu point matches no rule and no server takes nodb
+	err = mgr.Post(routingBatch("nodb"))
+	rerr, ok := err.(*endpoint.RoutingError)
+	if !ok || rerr.StatusCode() != http.StatusBadRequest || !strings.Contains(err.Error(), "1 points") {
+		t.Errorf("Expected a partial write for the unroutable point, got %v", err)
+	}
+	if k8s.Count() != 2 {
+		t.Errorf("The routable points should be written: %v", k8s.Lines)
+	}
+
+	// a failing backend doesn't keep the others from their points
+	err = mgr.Post(routingBatch("metrics"))
+	if err == nil || !strings.Contains(err.Error(), "engine down") {
+		t.Errorf("Expected the failure of down, got %v", err)
+	}
+	if other.Count() != 1 {
+		t.Errorf("Other should get its point: %v", other.Lines)
+	}
+}
+
+func TestRoutingRulesTagsAndFields(t *testing.T) {
+
+	var config = `
+	[server.1]
+	alias = "test1"
+
+	[[rule]]
+	name = "tags"
+	tags = { host = "^a$", dc = "" }
+	fields = ["value"]
+	backends = ["test1"]
+	`
+	mgr, err := endpoint.NewHTTPInfluxServerMgrFromConfig(config)
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+	r := mgr.Rules[0]
+	pt, _ := client.NewPoint("cpu",
+		map[string]string{"host": "a", "dc": "eu"},
+		map[string]interface{}{"value": 1.0},
+		time.Now())
+	if !r.MatchPoint(pt) {
+		t.Errorf("Point should match rule %v", r.Name)
+	}
+	pt, _ = client.NewPoint("cpu",
+		map[string]string{"host": "a"},
+		map[string]interface{}{"value": 1.0},
+		time.Now())
+	if r.MatchPoint(pt) {
+		t.Errorf("Point without dc tag should not match rule %v", r.Name)
+	}
+	pt, _ = client.NewPoint("cpu",
+		map[string]string{"host": "a", "dc": "eu"},
+		map[string]interface{}{"other": 1.0},
+		time.Now())
+	if r.MatchPoint(pt) {
+		t.Errorf("Point without value field should not match rule %v", r.Name)
+	}
+}
+
+func TestRoutingRulesAnchored(t *testing.T) {
+
+	var config = `
+	[server.1]
+	alias = "test1"
+
+	[[rule]]
+	name = "prod"
+	database = "prod"
+	backends = ["test1"]
+	`
+	mgr, err := endpoint.NewHTTPInfluxServerMgrFromConfig(config)
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+	r := mgr.Rules[0]
+	if !r.MatchBatch("prod", "") {
+		t.Errorf("Rule %v should match prod", r.Name)
+	}
+	for _, db := range []string{"preprod_x", "prod_x", "preprod"} {
+		if r.MatchBatch(db, "") {
+			t.Errorf("Rule %v should not match %v", r.Name, db)
+		}
+	}
+}
+
+func TestRoutingRulesInvalidConfig(t *testing.T) {
+
+	var unknown = `
+	[server.1]
+	alias = "test1"
+
+	[[rule]]
+	name = "unknown"
+	backends = ["test2"]
+	`
+	if _, err := endpoint.NewHTTPInfluxServerMgrFromConfig(unknown); err == nil {
+		t.Errorf("Should fail on unknown backend")
+	}
+
+	var invalid = `
+	[server.1]
+	alias = "test1"
+
+	[[rule]]
+	name = "invalid"
+	measurement = "k8s_("
+	backends = ["test1"]
+	`
+	if _, err := endpoint.NewHTTPInfluxServerMgrFromConfig(invalid); err == nil {
+		t.Errorf("Should fail on invalid regex")
+	}
+}
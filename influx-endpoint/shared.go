@@ -0,0 +1,471 @@
+package endpoint
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// sharedMembersFile lists the buffers
+// storing their records in a shared buffer
+const sharedMembersFile = "members"
+
+// blobRef counts the records referencing a blob
+type blobRef struct {
+	count int
+	size  int64
+}
+
+// SharedBuffer stores the bodies of the records of several
+// disk buffers once, named after their content: when backends
+// fail together, the batches they all buffer are written once.
+// A blob is removed once every buffer has released it.
+type SharedBuffer struct {
+	// blobs written, and records deduplicated on a stored blob
+	Stored       uint64
+	Deduplicated uint64
+	RootPath     string
+	// Budget accounts for the blobs, once
+	Budget *BufferBudget
+	// NoSweep keeps the blobs left unreferenced,
+	// for the tools opening some of the buffers only
+	NoSweep bool
+	// ReadOnly loads the blobs without writing
+	// to the shared buffer, implying NoSweep
+	ReadOnly bool
+	lock     sync.Mutex
+	refs     map[string]*blobRef
+	bytes    int64
+	// members are the buffers ever loaded on the shared
+	// buffer, persisted: the blobs left unreferenced are
+	// swept once they are all loaded by the process
+	members  map[string]bool
+	opened   map[string]bool
+	lockFile *os.File
+}
+
+// NewSharedBuffer creates a shared buffer in path
+func NewSharedBuffer(path string) *SharedBuffer {
+	return &SharedBuffer{
+		RootPath: path,
+		refs:     make(map[string]*blobRef),
+		opened:   make(map[string]bool),
+	}
+}
+
+// Attach makes the Bufferer store its records bodies in the
+// shared buffer. Memory and encrypted buffers keep their own.
+func (s *SharedBuffer) Attach(b *Bufferer) error {
+	if b.Type == BufferTypeMemory {
+		return fmt.Errorf("memory buffers are not shared")
+	}
+	if b.KeySource != "" || b.Keyring != nil {
+		return fmt.Errorf("encrypted buffers are not shared")
+	}
+	b.Shared = s
+	return nil
+}
+
+// blobPath returns the file of a blob,
+// spread over 256 directories
+func (s *SharedBuffer) blobPath(key string) string {
+	return filepath.Join(s.RootPath, key[:2], key)
+}
+
+// init creates the directory and locks it.
+// Must be called with the lock held.
+func (s *SharedBuffer) init() error {
+	if s.lockFile != nil || s.members != nil {
+		return nil
+	}
+	if !s.ReadOnly {
+		if err := os.MkdirAll(s.RootPath, 0755); err != nil {
+			return err
+		}
+	}
+	f, err := openLockFile(s.RootPath, s.ReadOnly)
+	if err != nil {
+		return err
+	}
+	if f != nil {
+		if err = lockFile(f); err != nil {
+			f.Close()
+			return fmt.Errorf("%v: %v", s.RootPath, ErrBufferLocked)
+		}
+		s.lockFile = f
+	}
+	return s.loadMembers()
+}
+
+// loadMembers reads the list of buffers, forgetting
+// those removed since. Must be called with the lock held.
+func (s *SharedBuffer) loadMembers() error {
+	s.members = make(map[string]bool)
+	data, err := ioutil.ReadFile(filepath.Join(s.RootPath, sharedMembersFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, path := range strings.Split(string(data), "\n") {
+		if path == "" {
+			continue
+		}
+		// a buffer removed holds no references
+		if _, err = os.Stat(path); err == nil {
+			s.members[path] = true
+		}
+	}
+	return nil
+}
+
+// join adds a buffer to the members.
+// Must be called with the lock held.
+func (s *SharedBuffer) join(root string) error {
+	if s.members[root] {
+		return nil
+	}
+	s.members[root] = true
+	var paths []string
+	for path := range s.members {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	data := []byte(strings.Join(paths, "\n") + "\n")
+	return writeFile(filepath.Join(s.RootPath, sharedMembersFile), data, &syncStats{})
+}
+
+// open locks the shared buffer for the process
+func (s *SharedBuffer) open() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.init()
+}
+
+// put stores a body and returns its key.
+// The blob is synced when syncs is set.
+func (s *SharedBuffer) put(body []byte, syncs *syncStats) (string, error) {
+	sum := sha256.Sum256(body)
+	key := hex.EncodeToString(sum[:])
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.init(); err != nil {
+		return "", err
+	}
+	if ref, ok := s.refs[key]; ok {
+		ref.count++
+		atomic.AddUint64(&s.Deduplicated, 1)
+		return key, nil
+	}
+	path := s.blobPath(key)
+	if _, err := os.Stat(filepath.Dir(path)); os.IsNotExist(err) {
+		if err = os.Mkdir(filepath.Dir(path), 0755); err != nil {
+			return "", err
+		}
+		if syncs != nil {
+			if err = syncs.dir(s.RootPath); err != nil {
+				return "", err
+			}
+		}
+	}
+	// a blob is complete or absent
+	if err := writeFile(path, body, syncs); err != nil {
+		return "", err
+	}
+	s.hold(key, int64(len(body)))
+	atomic.AddUint64(&s.Stored, 1)
+	return key, nil
+}
+
+// hold adds a reference to a blob on disk.
+// Must be called with the lock held.
+func (s *SharedBuffer) hold(key string, size int64) {
+	if ref, ok := s.refs[key]; ok {
+		ref.count++
+		return
+	}
+	s.refs[key] = &blobRef{count: 1, size: size}
+	s.bytes += size
+	if s.Budget != nil {
+		s.Budget.add(size, 0, 0)
+	}
+}
+
+// ref adds a reference to a blob found in a buffer
+// being loaded, returning its size. Returns false
+// if the blob is missing.
+func (s *SharedBuffer) ref(key string) (int64, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if ref, ok := s.refs[key]; ok {
+		ref.count++
+		return ref.size, true
+	}
+	if len(key) < 2 {
+		return 0, false
+	}
+	fi, err := os.Stat(s.blobPath(key))
+	if err != nil {
+		return 0, false
+	}
+	s.hold(key, fi.Size())
+	return fi.Size(), true
+}
+
+// get reads a blob
+func (s *SharedBuffer) get(key string) ([]byte, error) {
+	if len(key) < 2 {
+		return nil, errCorruptRecord
+	}
+	body, err := ioutil.ReadFile(s.blobPath(key))
+	if os.IsNotExist(err) {
+		// released and removed before a crash
+		return nil, errCorruptRecord
+	}
+	return body, err
+}
+
+// unref drops a reference to a blob, removing
+// it when remove is set and it is not used anymore
+func (s *SharedBuffer) unref(key string, remove bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ref, ok := s.refs[key]
+	if !ok {
+		return nil
+	}
+	if ref.count--; ref.count > 0 {
+		return nil
+	}
+	delete(s.refs, key)
+	s.bytes -= ref.size
+	if s.Budget != nil {
+		s.Budget.add(-ref.size, 0, 0)
+	}
+	if !remove {
+		return nil
+	}
+	if err := os.Remove(s.blobPath(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// loaded is called once the buffer in root is loaded. When
+// every member is, the blobs they don't reference are
+// left over by a crash and get removed.
+func (s *SharedBuffer) loaded(root string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ReadOnly {
+		return nil
+	}
+	if err := s.join(root); err != nil {
+		return err
+	}
+	s.opened[root] = true
+	if s.NoSweep {
+		return nil
+	}
+	for path := range s.members {
+		if !s.opened[path] {
+			return nil
+		}
+	}
+	n, err := s.sweep()
+	if err != nil {
+		log.Printf("Unable to sweep shared buffer %v: %v", s.RootPath, err)
+	}
+	if n > 0 {
+		log.Printf("Removed %v unreferenced blobs from %v", n, s.RootPath)
+	}
+	return nil
+}
+
+// sweep removes the blobs without references.
+// Must be called with the lock held.
+func (s *SharedBuffer) sweep() (int, error) {
+	dirs, err := ioutil.ReadDir(s.RootPath)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, d := range dirs {
+		if !d.IsDir() || len(d.Name()) != 2 {
+			continue
+		}
+		dir := filepath.Join(s.RootPath, d.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return n, err
+		}
+		for _, f := range files {
+			if _, ok := s.refs[f.Name()]; ok {
+				continue
+			}
+			if !strings.HasSuffix(f.Name(), ".tmp") {
+				n++
+			}
+			if err = os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close releases the lock of the shared buffer
+func (s *SharedBuffer) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.lockFile != nil {
+		s.lockFile.Close()
+		s.lockFile = nil
+	}
+	s.members = nil
+	s.opened = make(map[string]bool)
+}
+
+// Stats collects statistics from the shared buffer
+func (s *SharedBuffer) Stats() ([]models.Point, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var refs int
+	for _, ref := range s.refs {
+		refs += ref.count
+	}
+	fields := map[string]interface{}{
+		"blobs":        len(s.refs),
+		"references":   refs,
+		"bytes":        s.bytes,
+		"stored":       int64(atomic.LoadUint64(&s.Stored)),
+		"deduplicated": int64(atomic.LoadUint64(&s.Deduplicated)),
+	}
+	pt, err := models.NewPoint("sir_sharedbuffer", models.NewTags(map[string]string{}), fields, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return []models.Point{pt}, nil
+}
+
+// sharedStore keeps the records of a buffer in its own
+// log, with their bodies in the shared buffer
+type sharedStore struct {
+	recordStore
+	shared *SharedBuffer
+	// root is the absolute path of the buffer
+	root string
+	// syncs is set when the blobs are synced
+	syncs *syncStats
+	// references held, by blob
+	held map[string]int
+}
+
+func newSharedStore(log recordStore, shared *SharedBuffer, root string, syncs *syncStats) *sharedStore {
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	return &sharedStore{
+		recordStore: log,
+		shared:      shared,
+		root:        root,
+		syncs:       syncs,
+		held:        make(map[string]int),
+	}
+}
+
+func (s *sharedStore) Open() ([]*BufferFile, error) {
+	if err := s.shared.open(); err != nil {
+		return nil, err
+	}
+	index, err := s.recordStore.Open()
+	if err != nil {
+		return nil, err
+	}
+	for _, bf := range index {
+		if bf.Blob == "" {
+			continue
+		}
+		// a missing blob makes the record unreadable,
+		// it is skipped as corrupt
+		if size, ok := s.shared.ref(bf.Blob); ok {
+			bf.Shared = size
+			s.held[bf.Blob]++
+		}
+	}
+	if err = s.shared.loaded(s.root); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return index, nil
+}
+
+func (s *sharedStore) Append(rec *walRecord) (*BufferFile, error) {
+	if rec.KeyID != "" {
+		return s.recordStore.Append(rec)
+	}
+	key, err := s.shared.put(rec.Body, s.syncs)
+	if err != nil {
+		return nil, err
+	}
+	ref := *rec
+	ref.Blob = key
+	ref.Body = nil
+	bf, err := s.recordStore.Append(&ref)
+	if err != nil {
+		s.shared.unref(key, true)
+		return nil, err
+	}
+	bf.Shared = int64(len(rec.Body))
+	s.held[key]++
+	return bf, nil
+}
+
+func (s *sharedStore) Read(bf *BufferFile) (*walRecord, error) {
+	rec, err := s.recordStore.Read(bf)
+	if err != nil || rec.Blob == "" {
+		return rec, err
+	}
+	if rec.Body, err = s.shared.get(rec.Blob); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (s *sharedStore) Release(bf *BufferFile) error {
+	err := s.recordStore.Release(bf)
+	if bf.Blob == "" || s.held[bf.Blob] == 0 {
+		return err
+	}
+	if s.held[bf.Blob]--; s.held[bf.Blob] == 0 {
+		delete(s.held, bf.Blob)
+	}
+	if uerr := s.shared.unref(bf.Blob, true); uerr != nil && err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// Close drops the references held without removing
+// the blobs, the records are still in the log
+func (s *sharedStore) Close() error {
+	for key, n := range s.held {
+		for ; n > 0; n-- {
+			s.shared.unref(key, false)
+		}
+	}
+	s.held = make(map[string]int)
+	return s.recordStore.Close()
+}
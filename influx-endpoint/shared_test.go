@@ -0,0 +1,192 @@
+package endpoint_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+// countBlobs returns the number of blobs in a shared buffer
+func countBlobs(t *testing.T, dir string) int {
+	blobs, err := filepath.Glob(filepath.Join(dir, "??", "*"))
+	if err != nil {
+		t.Fatalf("Could not list blobs: %v", err)
+	}
+	return len(blobs)
+}
+
+func newSharedBufferers(t *testing.T, dir string) (*endpoint.SharedBuffer, []*endpoint.Bufferer) {
+	shared := endpoint.NewSharedBuffer(filepath.Join(dir, "shared"))
+	var buffers []*endpoint.Bufferer
+	for _, name := range []string{"a", "b"} {
+		b := endpoint.NewBufferer()
+		b.RootPath = filepath.Join(dir, name)
+		if err := shared.Attach(b); err != nil {
+			t.Fatalf("Could not attach Bufferer: %v", err)
+		}
+		buffers = append(buffers, b)
+	}
+	for _, b := range buffers {
+		if err := b.Init(); err != nil {
+			t.Fatalf("Could not init Bufferer: %v", err)
+		}
+	}
+	return shared, buffers
+}
+
+func TestSharedBuffer(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	shared, buffers := newSharedBufferers(t, dir)
+	bp := createBatch()
+	for _, b := range buffers {
+		if err := b.Write(bp); err != nil {
+			t.Fatalf("Could not Write batch: %v", err)
+		}
+	}
+	if n := countBlobs(t, shared.RootPath); n != 1 {
+		t.Fatalf("Expected 1 blob, got %v", n)
+	}
+	if shared.Stored != 1 || shared.Deduplicated != 1 {
+		t.Errorf("Expected 1 stored and 1 deduplicated, got %v and %v", shared.Stored, shared.Deduplicated)
+	}
+	if shared.Budget != nil {
+		t.Errorf("Unexpected budget")
+	}
+
+	// the encrypted buffers keep their own records
+	enc := endpoint.NewBufferer()
+	enc.KeySource = "env:SIR_TEST_KEY"
+	if err := shared.Attach(enc); err == nil {
+		t.Errorf("Expected encrypted buffers not to be shared")
+	}
+
+	// restarted, with a blob left over by a crash
+	for _, b := range buffers {
+		b.Close()
+	}
+	shared.Close()
+	orphan := filepath.Join(shared.RootPath, "ff", "ff00")
+	os.MkdirAll(filepath.Dir(orphan), 0755)
+	ioutil.WriteFile(orphan, []byte("lost"), 0644)
+	shared, buffers = newSharedBufferers(t, dir)
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("Expected the unreferenced blob to be removed: %v", err)
+	}
+
+	for i, b := range buffers {
+		out, err := b.Pop()
+		if err != nil || out == nil || len(out.Points()) != len(bp.Points()) {
+			t.Fatalf("Could not Pop batch from %v: %v %v", b.RootPath, out, err)
+		}
+		// the blob is kept until every buffer released it
+		if n := countBlobs(t, shared.RootPath); n != len(buffers)-1-i {
+			t.Errorf("Expected %v blobs, got %v", len(buffers)-1-i, n)
+		}
+	}
+	pts, err := shared.Stats()
+	if err != nil || len(pts) != 1 {
+		t.Fatalf("Could not get stats: %v", err)
+	}
+	fields, _ := pts[0].Fields()
+	if fields["blobs"] != int64(0) || fields["bytes"] != int64(0) {
+		t.Errorf("Wrong stats: %v", fields)
+	}
+}
+
+func TestSharedBufferFlushTiming(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the same batches, flushed at different times
+	shared, buffers := newSharedBufferers(t, dir)
+	batches := []client.BatchPoints{createBatch(), createBatch(), createBatch()}
+	for _, bp := range batches {
+		if err := buffers[0].Add(bp); err != nil {
+			t.Fatalf("Could not Add batch: %v", err)
+		}
+		if err := buffers[1].Add(bp); err != nil {
+			t.Fatalf("Could not Add batch: %v", err)
+		}
+		if err := buffers[1].Flush(); err != nil {
+			t.Fatalf("Could not flush: %v", err)
+		}
+	}
+	if err := buffers[0].Flush(); err != nil {
+		t.Fatalf("Could not flush: %v", err)
+	}
+	if shared.Stored != 3 || shared.Deduplicated != 3 {
+		t.Errorf("Expected 3 stored and 3 deduplicated, got %v and %v", shared.Stored, shared.Deduplicated)
+	}
+	if n := countBlobs(t, shared.RootPath); n != 3 {
+		t.Errorf("Expected 3 blobs, got %v", n)
+	}
+	for _, b := range buffers {
+		b.Close()
+	}
+	shared.Close()
+}
+
+func TestSharedBufferSubset(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	shared, buffers := newSharedBufferers(t, dir)
+	bp := createBatch()
+	bigger := createBatch()
+	bigger.AddPoint(bp.Points()[0])
+	if err := buffers[0].Write(bp); err != nil {
+		t.Fatalf("Could not Write batch: %v", err)
+	}
+	if err := buffers[1].Write(bigger); err != nil {
+		t.Fatalf("Could not Write batch: %v", err)
+	}
+	for _, b := range buffers {
+		b.Close()
+	}
+	shared.Close()
+
+	// the second buffer alone, as opened by sir buffer
+	// or by a relay with the first backend disabled
+	shared = endpoint.NewSharedBuffer(filepath.Join(dir, "shared"))
+	b := endpoint.NewBufferer()
+	b.RootPath = filepath.Join(dir, "b")
+	if err := shared.Attach(b); err != nil {
+		t.Fatalf("Could not attach Bufferer: %v", err)
+	}
+	if err := b.Init(); err != nil {
+		t.Fatalf("Could not init Bufferer: %v", err)
+	}
+	if n := countBlobs(t, shared.RootPath); n != 2 {
+		t.Errorf("Expected the blobs of the other buffer to be kept, got %v blobs", n)
+	}
+	b.Close()
+	shared.Close()
+
+	shared, buffers = newSharedBufferers(t, dir)
+	defer shared.Close()
+	for i, expected := range []int{1, 2} {
+		out, err := buffers[i].Pop()
+		if err != nil || out == nil || len(out.Points()) != expected {
+			t.Errorf("Could not Pop batch from %v: %v %v", buffers[i].RootPath, out, err)
+		}
+		buffers[i].Close()
+	}
+}
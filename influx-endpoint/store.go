@@ -0,0 +1,107 @@
+package endpoint
+
+import "errors"
+
+// Buffer types
+const (
+	BufferTypeDisk   string = "disk"
+	BufferTypeMemory string = "memory"
+	// DefaultMemoryBufferSize is the capacity in bytes
+	// of memory buffers without limits
+	DefaultMemoryBufferSize int64 = 64 * 1024 * 1024
+)
+
+// recordStore keeps the records of a Bufferer, in order.
+// Records are released oldest first.
+type recordStore interface {
+	// Open returns the index of the unread records
+	Open() ([]*BufferFile, error)
+	Append(rec *walRecord) (*BufferFile, error)
+	Read(bf *BufferFile) (*walRecord, error)
+	// Release drops the records up to bf
+	Release(bf *BufferFile) error
+	// Drained is called once all the records are released
+	Drained() error
+	Checkpoint() error
+	Close() error
+	// Size returns the bytes used by the store
+	Size() int64
+	// Files returns the number of files used by the store
+	Files() int
+	// Corrupt returns the number of records found corrupt
+	Corrupt() uint64
+	wouldRotate(size int64) bool
+}
+
+// validBufferType checks the buffer type is known
+func validBufferType(t string) error {
+	switch t {
+	case BufferTypeDisk, BufferTypeMemory:
+		return nil
+	}
+	return errors.New("Unknown buffer type " + t)
+}
+
+// memoryStore keeps the records in memory,
+// for hosts without a writable filesystem.
+// The records are lost on restart.
+type memoryStore struct {
+	records map[int64]*walRecord
+	next    int64
+	size    int64
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{records: make(map[int64]*walRecord)}
+}
+
+func (m *memoryStore) Open() ([]*BufferFile, error) {
+	return nil, nil
+}
+
+func (m *memoryStore) Append(rec *walRecord) (*BufferFile, error) {
+	bf := &BufferFile{
+		Filename:        BufferTypeMemory,
+		Offset:          m.next,
+		Size:            recordSize(rec),
+		NumMetrics:      rec.NumMetrics,
+		Database:        rec.Database,
+		RetentionPolicy: rec.RetentionPolicy,
+		Precision:       rec.Precision,
+		Timestamp:       rec.Timestamp,
+		KeyID:           rec.KeyID,
+	}
+	m.records[m.next] = rec
+	m.next++
+	m.size += bf.Size
+	return bf, nil
+}
+
+func (m *memoryStore) Read(bf *BufferFile) (*walRecord, error) {
+	rec, ok := m.records[bf.Offset]
+	if !ok {
+		return nil, errCorruptRecord
+	}
+	return rec, nil
+}
+
+func (m *memoryStore) Release(bf *BufferFile) error {
+	if _, ok := m.records[bf.Offset]; ok {
+		delete(m.records, bf.Offset)
+		m.size -= bf.Size
+	}
+	return nil
+}
+
+func (m *memoryStore) Drained() error {
+	m.records = make(map[int64]*walRecord)
+	m.size = 0
+	return nil
+}
+
+func (m *memoryStore) Checkpoint() error           { return nil }
+func (m *memoryStore) Close() error                { return nil }
+func (m *memoryStore) Size() int64                 { return m.size }
+func (m *memoryStore) Files() int                  { return 0 }
+func (m *memoryStore) Corrupt() uint64             { return 0 }
+func (m *memoryStore) wouldRotate(size int64) bool { return false }
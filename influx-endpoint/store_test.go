@@ -0,0 +1,61 @@
+package endpoint_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+func TestMemoryBuffer(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := endpoint.NewBufferer()
+	// never created
+	b.RootPath = filepath.Join(dir, "memory")
+	b.Type = endpoint.BufferTypeMemory
+	b.Limits.MaxPoints = 2
+	if err := b.Init(); err != nil {
+		t.Fatalf("Could not init Bufferer: %v", err)
+	}
+	for _, db := range []string{"a", "b", "c"} {
+		bp := createBatch()
+		bp.SetDatabase(db)
+		if err := b.Write(bp); err != nil {
+			t.Fatalf("Could not Write batch: %v", err)
+		}
+	}
+	if _, err := os.Stat(b.RootPath); !os.IsNotExist(err) {
+		t.Errorf("Memory buffer touched the filesystem: %v", err)
+	}
+	if b.Evicted != 1 {
+		t.Errorf("Expected 1 evicted point, got %v", b.Evicted)
+	}
+
+	pts, err := b.Stats()
+	// the total and one point per database
+	if err != nil || len(pts) != 3 {
+		t.Fatalf("Could not get stats: %v", err)
+	}
+	fields, _ := pts[0].Fields()
+	if fields["records"] != int64(2) || fields["bytes"].(int64) <= 0 {
+		t.Errorf("Wrong stats: %v", fields)
+	}
+
+	for _, db := range []string{"b", "c"} {
+		bp, err := b.Pop()
+		if err != nil || bp == nil || bp.Database() != db {
+			t.Fatalf("Expected batch %v, got %v (%v)", db, bp, err)
+		}
+	}
+	if bp, _ := b.Pop(); bp != nil {
+		t.Errorf("Expected an empty buffer")
+	}
+}
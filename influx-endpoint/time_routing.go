@@ -0,0 +1,112 @@
+package endpoint
+
+import (
+	"fmt"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+)
+
+// TimeRoutingConfig is the struct to map
+// the time based routing from config items
+type TimeRoutingConfig struct {
+	Enable    bool
+	Threshold duration
+	DBregex   []string `toml:"db_regex"`
+	Recent    []string `toml:"recent"`
+	Backfill  []string `toml:"backfill"`
+}
+
+// TimeRouting splits the points of a batch on their age:
+// points younger than Threshold go to the Recent servers,
+// older points go to the Backfill servers.
+type TimeRouting struct {
+	Threshold       time.Duration
+	databases       []*regexp.Regexp
+	Recent          []*HTTPInfluxServer
+	Backfill        []*HTTPInfluxServer
+	RecentCounter   uint64
+	BackfillCounter uint64
+}
+
+func resolveServers(name string, aliases []string, endpoints map[string]*HTTPInfluxServer) ([]*HTTPInfluxServer, error) {
+	var ret []*HTTPInfluxServer
+	for _, alias := range aliases {
+		s, ok := endpoints[alias]
+		if !ok {
+			return ret, fmt.Errorf("%v references unknown backend %v", name, alias)
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+// NewTimeRoutingFromConfig creates the time routing from
+// a given config struct, resolving the backend aliases
+// against the known endpoints.
+// Returns nil if the time routing is disabled.
+func NewTimeRoutingFromConfig(c *TimeRoutingConfig, endpoints map[string]*HTTPInfluxServer) (*TimeRouting, error) {
+	if !c.Enable {
+		return nil, nil
+	}
+	var err error
+	tr := &TimeRouting{
+		Threshold: c.Threshold.toTimeDuration(),
+	}
+	if tr.Threshold <= 0 {
+		return nil, fmt.Errorf("Time routing threshold must be positive")
+	}
+	if tr.Recent, err = resolveServers("Time routing", c.Recent, endpoints); err != nil {
+		return nil, err
+	}
+	if tr.Backfill, err = resolveServers("Time routing", c.Backfill, endpoints); err != nil {
+		return nil, err
+	}
+	if len(tr.Recent) == 0 || len(tr.Backfill) == 0 {
+		return nil, fmt.Errorf("Time routing needs both recent and backfill backends")
+	}
+	dbregex := c.DBregex
+	if len(dbregex) == 0 {
+		dbregex = []string{".*"}
+	}
+	if tr.databases, err = compileDBPatterns("time routing", dbregex); err != nil {
+		return nil, err
+	}
+	return tr, nil
+}
+
+// Match returns true if the time routing applies to the database
+func (tr *TimeRouting) Match(db string) bool {
+	for _, reg := range tr.databases {
+		if reg.MatchString(db) {
+			return true
+		}
+	}
+	return false
+}
+
+// route returns the servers for the point given its age.
+func (tr *TimeRouting) route(p *client.Point, now time.Time) []*HTTPInfluxServer {
+	if now.Sub(p.Time()) > tr.Threshold {
+		atomic.AddUint64(&tr.BackfillCounter, 1)
+		return tr.Backfill
+	}
+	atomic.AddUint64(&tr.RecentCounter, 1)
+	return tr.Recent
+}
+
+// Stats return a data point with the counters of each branch
+func (tr *TimeRouting) Stats() ([]models.Point, error) {
+	fields := map[string]interface{}{
+		"recent":   int64(atomic.LoadUint64(&tr.RecentCounter)),
+		"backfill": int64(atomic.LoadUint64(&tr.BackfillCounter)),
+	}
+	pt, err := models.NewPoint("sir_timerouting", models.NewTags(map[string]string{}), fields, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return []models.Point{pt}, nil
+}
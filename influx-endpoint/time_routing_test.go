@@ -0,0 +1,100 @@
+package endpoint_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+func TestTimeRoutingSplit(t *testing.T) {
+
+	hot := newRecordingTestServer()
+	defer hot.Close()
+	cold := newRecordingTestServer()
+	defer cold.Close()
+
+	var config = `
+	[server.1]
+	alias = "hot"
+
+	[server.2]
+	alias = "cold"
+
+	[time_routing]
+	enable = true
+	threshold = "48h"
+	db_regex = ["telegraf"]
+	recent = ["hot"]
+	backfill = ["cold"]
+	`
+	mgr, err := endpoint.NewHTTPInfluxServerMgrFromConfig(config)
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+	mgr.Endpoints["hot"].Config.Addr = hot.URL
+	mgr.Endpoints["cold"].Config.Addr = cold.URL
+	for _, s := range mgr.Endpoints {
+		if err := s.Connect(); err != nil {
+			t.Fatalf("Could not connect: %v", err)
+		}
+	}
+
+	bp, _ := client.NewBatchPoints(client.BatchPointsConfig{Database: "telegraf"})
+	for _, age := range []time.Duration{time.Minute, time.Hour, 72 * time.Hour} {
+		pt, _ := client.NewPoint("cpu", nil,
+			map[string]interface{}{"value": 1.0},
+			time.Now().Add(-age))
+		bp.AddPoint(pt)
+	}
+	if err = mgr.Post(bp); err != nil {
+		t.Fatalf("Could not post: %v", err)
+	}
+	if hot.Count() != 2 || cold.Count() != 1 {
+		t.Errorf("Wrong split: hot=%v cold=%v", hot.Lines, cold.Lines)
+	}
+	if mgr.TimeRouting.RecentCounter != 2 || mgr.TimeRouting.BackfillCounter != 1 {
+		t.Errorf("Wrong counters: recent=%v backfill=%v",
+			mgr.TimeRouting.RecentCounter, mgr.TimeRouting.BackfillCounter)
+	}
+
+	// other databases are routed by db_regex only
+	bp.SetDatabase("other")
+	if err = mgr.Post(bp); err != nil {
+		t.Fatalf("Could not post: %v", err)
+	}
+	if hot.Count() != 5 || cold.Count() != 4 {
+		t.Errorf("Wrong routing: hot=%v cold=%v", hot.Lines, cold.Lines)
+	}
+
+	stats, err := mgr.Stats()
+	if err != nil {
+		t.Fatalf("Couldn't get stats: %v", err)
+	}
+	found := false
+	for _, p := range stats.Points() {
+		if p.Name() == "sir_timerouting" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Time routing statistics not reported")
+	}
+}
+
+func TestTimeRoutingInvalidConfig(t *testing.T) {
+
+	var config = `
+	[server.1]
+	alias = "hot"
+
+	[time_routing]
+	enable = true
+	threshold = "48h"
+	recent = ["hot"]
+	`
+	if _, err := endpoint.NewHTTPInfluxServerMgrFromConfig(config); err == nil {
+		t.Errorf("Should fail without backfill backends")
+	}
+}
@@ -0,0 +1,644 @@
+package endpoint
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// walVersion is the version of the record format,
+	// version 1 records have no codec, version 2
+	// records no key id and version 3 records no blob.
+	// The checksum of records before version 5
+	// doesn't cover their length.
+	walVersion byte = 5
+	// walHeaderSize is the size of the length and checksum
+	// preceding each record payload
+	walHeaderSize = 8
+	// walMaxRecordSize bounds the size of a record, anything
+	// bigger is considered as a corrupt length
+	walMaxRecordSize = 256 * 1024 * 1024
+	// walSegmentExt is the extension of segment files
+	walSegmentExt = ".wal"
+	// walOffsetFile persists the read position
+	walOffsetFile = "offset.json"
+	// DefaultSegmentSize is the size after which segments are rotated
+	DefaultSegmentSize int64 = 16 * 1024 * 1024
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+	// errCorruptRecord is returned when a record checksum doesn't match
+	errCorruptRecord = errors.New("corrupt record")
+	// errTruncatedRecord is returned when a record is cut short
+	errTruncatedRecord = errors.New("truncated record")
+	// errRecordTooLarge is returned when appending a record
+	// bigger than what the log can read back
+	errRecordTooLarge = errors.New("record too large")
+)
+
+// walRecord is a batch as stored in the log
+type walRecord struct {
+	Database        string
+	RetentionPolicy string
+	Precision       string
+	NumMetrics      int
+	Timestamp       time.Time
+	Codec           byte
+	// KeyID names the key encrypting the body, if any
+	KeyID string
+	// Blob names the body kept by a shared buffer, if any
+	Blob string
+	Body []byte
+	// sealed is the header of an encrypted record as stored,
+	// authenticated with the body whatever its version
+	sealed []byte
+}
+
+func putString(buf *bytes.Buffer, s string) {
+	var l [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(l[:], uint64(len(s)))
+	buf.Write(l[:n])
+	buf.WriteString(s)
+}
+
+func getString(r *bytes.Reader) (string, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if l > uint64(r.Len()) {
+		return "", errCorruptRecord
+	}
+	s := make([]byte, l)
+	_, err = io.ReadFull(r, s)
+	return string(s), err
+}
+
+// encode returns the record payload.
+// Encrypted records keep the header they were sealed with.
+func (r *walRecord) encode() []byte {
+	if r.sealed != nil {
+		payload := make([]byte, 0, len(r.sealed)+len(r.Body))
+		return append(append(payload, r.sealed...), r.Body...)
+	}
+	return append(r.header(), r.Body...)
+}
+
+// authenticated returns the header
+// authenticated with an encrypted body
+func (r *walRecord) authenticated() []byte {
+	if r.sealed != nil {
+		return r.sealed
+	}
+	return r.header()
+}
+
+// headerSize returns the size of the header
+// without encoding it
+func (r *walRecord) headerSize() int {
+	if r.sealed != nil {
+		return len(r.sealed)
+	}
+	var l [binary.MaxVarintLen64]byte
+	size := 2 + 8 + 4
+	for _, s := range []string{r.Database, r.RetentionPolicy, r.Precision, r.KeyID, r.Blob} {
+		size += binary.PutUvarint(l[:], uint64(len(s))) + len(s)
+	}
+	return size
+}
+
+// header returns the record payload before the body
+func (r *walRecord) header() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, len(r.Body)+64))
+	buf.WriteByte(walVersion)
+	buf.WriteByte(r.Codec)
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(r.Timestamp.UnixNano()))
+	buf.Write(n[:])
+	binary.BigEndian.PutUint32(n[:4], uint32(r.NumMetrics))
+	buf.Write(n[:4])
+	putString(buf, r.Database)
+	putString(buf, r.RetentionPolicy)
+	putString(buf, r.Precision)
+	putString(buf, r.KeyID)
+	putString(buf, r.Blob)
+	return buf.Bytes()
+}
+
+// decodeWalRecord parses a record payload
+func decodeWalRecord(payload []byte) (*walRecord, error) {
+	r := bytes.NewReader(payload)
+	version, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	codec := codecDetect
+	switch version {
+	case 1:
+	case 2, 3, 4, walVersion:
+		if codec, err = r.ReadByte(); err != nil {
+			return nil, errCorruptRecord
+		}
+	default:
+		return nil, fmt.Errorf("unknown record version %v", version)
+	}
+	var n [8]byte
+	if _, err = io.ReadFull(r, n[:]); err != nil {
+		return nil, errCorruptRecord
+	}
+	rec := &walRecord{
+		Timestamp: time.Unix(0, int64(binary.BigEndian.Uint64(n[:]))),
+		Codec:     codec,
+	}
+	if _, err = io.ReadFull(r, n[:4]); err != nil {
+		return nil, errCorruptRecord
+	}
+	rec.NumMetrics = int(binary.BigEndian.Uint32(n[:4]))
+	if rec.Database, err = getString(r); err != nil {
+		return nil, errCorruptRecord
+	}
+	if rec.RetentionPolicy, err = getString(r); err != nil {
+		return nil, errCorruptRecord
+	}
+	if rec.Precision, err = getString(r); err != nil {
+		return nil, errCorruptRecord
+	}
+	if version >= 3 {
+		if rec.KeyID, err = getString(r); err != nil {
+			return nil, errCorruptRecord
+		}
+	}
+	if version >= 4 {
+		if rec.Blob, err = getString(r); err != nil {
+			return nil, errCorruptRecord
+		}
+	}
+	rec.Body = payload[len(payload)-r.Len():]
+	if rec.KeyID != "" {
+		rec.sealed = payload[:len(payload)-r.Len()]
+	}
+	return rec, nil
+}
+
+// readRecord reads the record at the current position of the reader.
+// It returns the payload and the number of bytes consumed.
+func readRecord(r io.Reader) ([]byte, int64, error) {
+	var header [walHeaderSize]byte
+	if n, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return nil, 0, io.EOF
+		}
+		return nil, int64(n), errTruncatedRecord
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length > walMaxRecordSize {
+		return nil, walHeaderSize, errTruncatedRecord
+	}
+	payload := make([]byte, length)
+	if n, err := io.ReadFull(r, payload); err != nil {
+		return nil, int64(walHeaderSize + n), errTruncatedRecord
+	}
+	size := int64(walHeaderSize + length)
+	sum := binary.BigEndian.Uint32(header[4:])
+	if recordChecksum(header[:4], payload) != sum {
+		// older records only checksum their payload
+		if length == 0 || payload[0] >= 5 || crc32.Checksum(payload, crcTable) != sum {
+			return nil, size, errCorruptRecord
+		}
+	}
+	return payload, size, nil
+}
+
+// recordChecksum returns the checksum of
+// the record length followed by its payload
+func recordChecksum(length, payload []byte) uint32 {
+	return crc32.Update(crc32.Checksum(length, crcTable), crcTable, payload)
+}
+
+// walPosition is the position of the next record to read
+type walPosition struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// segmentLog is an append-only log of records,
+// split into numbered segment files.
+// It is not safe for concurrent use.
+type segmentLog struct {
+	dir            string
+	maxSegmentSize int64
+	// segments holds the ids of the segments on disk, in order
+	segments  []uint64
+	writer    *os.File
+	writeID   uint64
+	writeSize int64
+	read      walPosition
+	saved     walPosition
+	Corrupted uint64
+	// syncMode is one of the buffer sync modes,
+	// dirty is set by the writes not yet synced
+	syncMode string
+	syncs    *syncStats
+	dirty    bool
+	// readOnly keeps the segments and
+	// the read position as they are
+	readOnly bool
+}
+
+func segmentName(id uint64) string {
+	return fmt.Sprintf("%016d%s", id, walSegmentExt)
+}
+
+func newSegmentLog(dir string, maxSegmentSize int64) *segmentLog {
+	if maxSegmentSize <= 0 {
+		maxSegmentSize = DefaultSegmentSize
+	}
+	return &segmentLog{
+		dir:            dir,
+		maxSegmentSize: maxSegmentSize,
+		syncMode:       BufferSyncNone,
+		syncs:          &syncStats{},
+	}
+}
+
+// durable returns the stats to sync files with,
+// nil if they are not synced
+func (l *segmentLog) durable() *syncStats {
+	if l.syncMode == BufferSyncNone {
+		return nil
+	}
+	return l.syncs
+}
+
+// flush syncs the writes made to the current segment
+func (l *segmentLog) flush() error {
+	if l.syncMode == BufferSyncNone || !l.dirty || l.writer == nil {
+		return nil
+	}
+	if err := l.syncs.file(l.writer); err != nil {
+		return err
+	}
+	l.dirty = false
+	return nil
+}
+
+// listSegments returns the ids of the segments found in dir
+func listSegments(dir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), walSegmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), walSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// loadPosition reads the persisted read position.
+// A damaged position is reset to the start of the log:
+// records are replayed again rather than lost.
+func (l *segmentLog) loadPosition() error {
+	b, err := ioutil.ReadFile(filepath.Join(l.dir, walOffsetFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(b, &l.read); err != nil {
+		log.Printf("Ignoring damaged read position in %v: %v", l.dir, err)
+		l.read = walPosition{}
+	}
+	l.saved = l.read
+	return nil
+}
+
+// Checkpoint syncs the current segment under the interval
+// sync mode and persists the read position if it moved
+func (l *segmentLog) Checkpoint() error {
+	if err := l.flush(); err != nil {
+		return err
+	}
+	if l.read == l.saved || l.readOnly {
+		return nil
+	}
+	b, err := json.Marshal(l.read)
+	if err != nil {
+		return err
+	}
+	if err = writeFile(filepath.Join(l.dir, walOffsetFile), b, l.durable()); err != nil {
+		return err
+	}
+	l.saved = l.read
+	return nil
+}
+
+// Open scans the segments from the persisted read position
+// and returns the unread records. Corrupt records are skipped
+// and a truncated tail is ignored.
+func (l *segmentLog) Open() ([]*BufferFile, error) {
+	var index []*BufferFile
+	var err error
+	if err = l.loadPosition(); err != nil {
+		return nil, fmt.Errorf("Unable to read position: %v", err)
+	}
+	if l.segments, err = listSegments(l.dir); err != nil {
+		return nil, err
+	}
+
+	for _, id := range l.segments {
+		if id < l.read.Segment {
+			// already consumed
+			if !l.readOnly {
+				os.Remove(filepath.Join(l.dir, segmentName(id)))
+			}
+			continue
+		}
+		start := int64(0)
+		if id == l.read.Segment {
+			start = l.read.Offset
+		}
+		entries, err := l.scanSegment(id, start)
+		if err != nil {
+			return nil, err
+		}
+		index = append(index, entries...)
+		if id >= l.writeID {
+			l.writeID = id
+		}
+	}
+	// never append to an existing segment,
+	// its tail could be damaged
+	if l.read.Segment > l.writeID {
+		l.writeID = l.read.Segment
+	}
+	l.writeID++
+	l.segments = l.liveSegments()
+	return index, nil
+}
+
+// liveSegments returns the segments not yet removed
+func (l *segmentLog) liveSegments() []uint64 {
+	var ids []uint64
+	for _, id := range l.segments {
+		if id >= l.read.Segment {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// scanSegment reads the records headers of a segment from an offset
+func (l *segmentLog) scanSegment(id uint64, start int64) ([]*BufferFile, error) {
+	var entries []*BufferFile
+	fd, err := os.Open(filepath.Join(l.dir, segmentName(id)))
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	if _, err = fd.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(fd)
+	offset := start
+	for {
+		payload, size, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err == errTruncatedRecord {
+			// nothing can be trusted after a bad length
+			l.Corrupted++
+			break
+		}
+		if err == nil {
+			var rec *walRecord
+			if rec, err = decodeWalRecord(payload); err == nil {
+				entries = append(entries, &BufferFile{
+					Filename:        segmentName(id),
+					Segment:         id,
+					Offset:          offset,
+					Size:            size,
+					NumMetrics:      rec.NumMetrics,
+					Database:        rec.Database,
+					RetentionPolicy: rec.RetentionPolicy,
+					Precision:       rec.Precision,
+					Timestamp:       rec.Timestamp,
+					KeyID:           rec.KeyID,
+					Blob:            rec.Blob,
+				})
+			}
+		}
+		if err != nil {
+			// the record is skipped, the next one is still reachable
+			l.Corrupted++
+		}
+		offset += size
+	}
+	return entries, nil
+}
+
+// rotate closes the current segment and starts a new one
+func (l *segmentLog) rotate() error {
+	if l.writer != nil {
+		if err := l.flush(); err != nil {
+			return err
+		}
+		if err := l.writer.Close(); err != nil {
+			return err
+		}
+		l.writer = nil
+		l.writeID++
+	}
+	fd, err := os.OpenFile(filepath.Join(l.dir, segmentName(l.writeID)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if syncs := l.durable(); syncs != nil {
+		// the new segment must survive a crash
+		if err = syncs.dir(l.dir); err != nil {
+			fd.Close()
+			return err
+		}
+	}
+	l.writer = fd
+	l.writeSize = 0
+	l.segments = append(l.segments, l.writeID)
+	return nil
+}
+
+// recordSize returns the size of the record in the log
+func recordSize(rec *walRecord) int64 {
+	return int64(walHeaderSize + rec.headerSize() + len(rec.Body))
+}
+
+// wouldRotate returns true if appending a record
+// of the given size starts a new segment
+func (l *segmentLog) wouldRotate(size int64) bool {
+	return l.writer == nil || (l.writeSize > 0 && l.writeSize+size > l.maxSegmentSize)
+}
+
+// Append writes a record at the end of the log
+func (l *segmentLog) Append(rec *walRecord) (*BufferFile, error) {
+	if l.readOnly {
+		return nil, fmt.Errorf("Buffer %v is read-only", l.dir)
+	}
+	payload := rec.encode()
+	if len(payload) > walMaxRecordSize {
+		return nil, errRecordTooLarge
+	}
+	size := int64(walHeaderSize + len(payload))
+	if l.wouldRotate(size) {
+		if err := l.rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], recordChecksum(buf[:4], payload))
+	copy(buf[walHeaderSize:], payload)
+	if _, err := l.writer.Write(buf); err != nil {
+		return nil, err
+	}
+	l.dirty = true
+	if l.syncMode == BufferSyncAlways {
+		if err := l.flush(); err != nil {
+			return nil, err
+		}
+	}
+	bf := &BufferFile{
+		Filename:        segmentName(l.writeID),
+		Segment:         l.writeID,
+		Offset:          l.writeSize,
+		Size:            size,
+		NumMetrics:      rec.NumMetrics,
+		Database:        rec.Database,
+		RetentionPolicy: rec.RetentionPolicy,
+		Precision:       rec.Precision,
+		Timestamp:       rec.Timestamp,
+		KeyID:           rec.KeyID,
+		Blob:            rec.Blob,
+	}
+	l.writeSize += size
+	return bf, nil
+}
+
+// Read returns the record described by the index entry
+func (l *segmentLog) Read(bf *BufferFile) (*walRecord, error) {
+	fd, err := os.Open(filepath.Join(l.dir, segmentName(bf.Segment)))
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	if _, err = fd.Seek(bf.Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	payload, _, err := readRecord(fd)
+	if err != nil {
+		return nil, err
+	}
+	return decodeWalRecord(payload)
+}
+
+// Release moves the read position after the record
+// and removes the segments fully read.
+func (l *segmentLog) Release(bf *BufferFile) error {
+	l.read = walPosition{Segment: bf.Segment, Offset: bf.Offset + bf.Size}
+	var err error
+	for len(l.segments) > 0 && l.segments[0] < l.read.Segment {
+		if rerr := os.Remove(filepath.Join(l.dir, segmentName(l.segments[0]))); rerr != nil && !os.IsNotExist(rerr) {
+			err = rerr
+		}
+		l.segments = l.segments[1:]
+	}
+	return err
+}
+
+// Drained is called when every record has been read:
+// the closed segments are removed and the read position
+// is moved to the end of the log.
+func (l *segmentLog) Drained() error {
+	var err error
+	var keep []uint64
+	for _, id := range l.segments {
+		if l.writer != nil && id == l.writeID {
+			keep = append(keep, id)
+			continue
+		}
+		if rerr := os.Remove(filepath.Join(l.dir, segmentName(id))); rerr != nil && !os.IsNotExist(rerr) {
+			err = rerr
+		}
+	}
+	l.segments = keep
+	if l.writer != nil {
+		l.read = walPosition{Segment: l.writeID, Offset: l.writeSize}
+	} else {
+		l.read = walPosition{Segment: l.writeID}
+	}
+	if cerr := l.Checkpoint(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Size returns the number of bytes used by the segments
+func (l *segmentLog) Size() int64 {
+	var size int64
+	for _, id := range l.segments {
+		if fi, err := os.Stat(filepath.Join(l.dir, segmentName(id))); err == nil {
+			size += fi.Size()
+		}
+	}
+	return size
+}
+
+// Files returns the number of segments on disk
+func (l *segmentLog) Files() int {
+	return len(l.segments)
+}
+
+// Corrupt returns the number of corrupt records skipped
+func (l *segmentLog) Corrupt() uint64 {
+	return l.Corrupted
+}
+
+// Close closes the current segment and persists the read position
+func (l *segmentLog) Close() error {
+	err := l.flush()
+	if l.writer != nil {
+		if cerr := l.writer.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		l.writer = nil
+		l.writeID++
+	}
+	if cerr := l.Checkpoint(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,190 @@
+package endpoint_test
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sledigabel/sir/influx-endpoint"
+)
+
+func newTestBufferer(t *testing.T, dir string) *endpoint.Bufferer {
+	b := endpoint.NewBufferer()
+	b.RootPath = dir
+	if err := b.Init(); err != nil {
+		t.Fatalf("Could not init Bufferer: %v", err)
+	}
+	return b
+}
+
+func segments(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if err != nil {
+		t.Fatalf("Could not list segments: %v", err)
+	}
+	return files
+}
+
+func TestWALRotationAndCleanup(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := endpoint.NewBufferer()
+	b.RootPath = dir
+	b.SegmentSize = 100
+	if err := b.Init(); err != nil {
+		t.Fatalf("Could not init Bufferer: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := b.Write(createBatch()); err != nil {
+			t.Fatalf("Could not Write batch: %v", err)
+		}
+	}
+	if n := len(segments(t, dir)); n != 5 {
+		t.Errorf("Expected 5 segments, got %v", n)
+	}
+	for i := 0; i < 5; i++ {
+		bp, err := b.Pop()
+		if err != nil || bp == nil || len(bp.Points()) != 1 {
+			t.Fatalf("Could not pop batch %v: %v", i, err)
+		}
+	}
+	if n := len(segments(t, dir)); n > 1 {
+		t.Errorf("Consumed segments were not removed: %v", n)
+	}
+}
+
+func TestWALReadOffsetPersisted(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := newTestBufferer(t, dir)
+	for i := 0; i < 3; i++ {
+		if err := b.Write(createBatch()); err != nil {
+			t.Fatalf("Could not Write batch: %v", err)
+		}
+	}
+	if _, err := b.Pop(); err != nil {
+		t.Fatalf("Could not pop: %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Could not close: %v", err)
+	}
+
+	newb := newTestBufferer(t, dir)
+	if len(newb.Index) != 2 {
+		t.Fatalf("Expected 2 records after reload, got %v", len(newb.Index))
+	}
+	// new writes go after the existing records
+	bp := createBatch()
+	bp.SetDatabase("Wasp")
+	if err := newb.Write(bp); err != nil {
+		t.Fatalf("Could not Write batch: %v", err)
+	}
+	for _, db := range []string{"BumbleBeeTuna", "BumbleBeeTuna", "Wasp"} {
+		bp, err := newb.Pop()
+		if err != nil || bp == nil || bp.Database() != db {
+			t.Fatalf("Wrong order after reload: %v %v", bp, err)
+		}
+	}
+}
+
+func TestWALCorruptRecords(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := newTestBufferer(t, dir)
+	for i := 0; i < 3; i++ {
+		if err := b.Write(createBatch()); err != nil {
+			t.Fatalf("Could not Write batch: %v", err)
+		}
+	}
+	second := b.Index[1]
+	b.Close()
+
+	// flip a byte in the second record and truncate the last one
+	seg := filepath.Join(dir, second.Filename)
+	content, err := ioutil.ReadFile(seg)
+	if err != nil {
+		t.Fatalf("Could not read segment: %v", err)
+	}
+	content[second.Offset+second.Size-2] ^= 0xff
+	content = content[:len(content)-5]
+	if err = ioutil.WriteFile(seg, content, 0644); err != nil {
+		t.Fatalf("Could not write segment: %v", err)
+	}
+
+	newb := newTestBufferer(t, dir)
+	if len(newb.Index) != 1 {
+		t.Fatalf("Expected 1 valid record, got %v", len(newb.Index))
+	}
+	bp, err := newb.Pop()
+	if err != nil || bp == nil {
+		t.Fatalf("Could not pop the valid record: %v", err)
+	}
+	if bp, err = newb.Pop(); bp != nil || err != nil {
+		t.Fatalf("Expected an empty buffer: %v %v", bp, err)
+	}
+}
+
+func TestWALLegacyChecksum(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bufferer")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := newTestBufferer(t, dir)
+	for i := 0; i < 2; i++ {
+		if err := b.Write(createBatch()); err != nil {
+			t.Fatalf("Could not Write batch: %v", err)
+		}
+	}
+	first, second := b.Index[0], b.Index[1]
+	b.Close()
+
+	// rewrite the first record as a version 4 one, its checksum
+	// covering the payload only, and give the second one the
+	// same checksum without downgrading it
+	seg := filepath.Join(dir, first.Filename)
+	content, err := ioutil.ReadFile(seg)
+	if err != nil {
+		t.Fatalf("Could not read segment: %v", err)
+	}
+	table := crc32.MakeTable(crc32.Castagnoli)
+	for i, bf := range []*endpoint.BufferFile{first, second} {
+		record := content[bf.Offset : bf.Offset+bf.Size]
+		if i == 0 {
+			record[8] = 4
+		}
+		binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(record[8:], table))
+	}
+	if err = ioutil.WriteFile(seg, content, 0644); err != nil {
+		t.Fatalf("Could not write segment: %v", err)
+	}
+
+	newb := newTestBufferer(t, dir)
+	if len(newb.Index) != 1 || newb.Index[0].Offset != first.Offset {
+		t.Fatalf("Expected the legacy record only, got %v", newb.Index)
+	}
+	bp, err := newb.Pop()
+	if err != nil || bp == nil || len(bp.Points()) == 0 {
+		t.Fatalf("Could not pop the legacy record: %v %v", bp, err)
+	}
+}
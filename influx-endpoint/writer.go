@@ -0,0 +1,117 @@
+package endpoint
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// WriteError is returned when a backend
+// answers a write with an error status
+type WriteError struct {
+	Code int
+	msg  string
+}
+
+func (e *WriteError) Error() string {
+	return e.msg
+}
+
+// Permanent returns true when the backend refused the batch
+// itself, writing it again would fail the same way. The
+// authorization and not found errors depend on the settings
+// of the backend and may succeed later.
+func (e *WriteError) Permanent() bool {
+	switch e.Code {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound,
+		http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return e.Code >= 400 && e.Code < 500
+}
+
+// permanentError returns true if err is a permanent WriteError
+func permanentError(err error) bool {
+	werr, ok := err.(*WriteError)
+	return ok && werr.Permanent()
+}
+
+// newHTTPClient creates the HTTP client of the writes
+// from the config as the Influx client builds its own
+func newHTTPClient(config *client.HTTPConfig) *http.Client {
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify},
+		Proxy:           config.Proxy,
+	}
+	if config.TLSConfig != nil {
+		tr.TLSClientConfig = config.TLSConfig
+	}
+	return &http.Client{
+		Timeout:   config.Timeout,
+		Transport: tr,
+	}
+}
+
+// write posts the batch points as the Influx client does,
+// returning a WriteError with the status of a failed write
+func (server *HTTPInfluxServer) write(bp client.BatchPoints, username, password string) error {
+	if server.httpClient == nil {
+		return fmt.Errorf("Server %v is not connected", server.Alias)
+	}
+	var body bytes.Buffer
+	for _, p := range bp.Points() {
+		if p == nil {
+			continue
+		}
+		body.WriteString(p.PrecisionString(bp.Precision()))
+		body.WriteByte('\n')
+	}
+	u, err := url.Parse(server.Config.Addr)
+	if err != nil {
+		return err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/write"
+	params := url.Values{}
+	params.Set("db", bp.Database())
+	params.Set("rp", bp.RetentionPolicy())
+	params.Set("precision", bp.Precision())
+	params.Set("consistency", bp.WriteConsistency())
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequest("POST", u.String(), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "")
+	userAgent := server.Config.UserAgent
+	if userAgent == "" {
+		userAgent = "InfluxDBClient"
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err := server.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	answer, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		msg := strings.TrimSpace(string(answer))
+		if msg == "" {
+			msg = fmt.Sprintf("write failed with status %v", resp.StatusCode)
+		}
+		return &WriteError{Code: resp.StatusCode, msg: msg}
+	}
+	return nil
+}
@@ -34,5 +34,6 @@ func ParseRelay(s string) (*Relay, error) {
 	r.Listener = httplistener.NewHTTPfromConfig(httpconfig)
 	r.Backend, err = endpoint.NewHTTPInfluxServerMgrFromConfig(s)
 	r.Listener.BackendMgr = r.Backend
+	r.Backend.Collectors = append(r.Backend.Collectors, r.Listener)
 	return r, err
 }